@@ -0,0 +1,270 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"regexp/syntax"
+)
+
+// Limits on the shape of a subscription expression enforced by
+// Analyse. A zero limit is not enforced.
+type ExpressionLimits struct {
+	MaxDepth      int // Nodes on the longest path from the root
+	MaxNodes      int // Nodes in the whole expression
+	MaxRegexpSize int // Instructions in a compiled regex() or wildcard() pattern
+}
+
+// Limits suitable for a router serving untrusted clients
+var DefaultExpressionLimits = ExpressionLimits{
+	MaxDepth:      64,
+	MaxNodes:      4096,
+	MaxRegexpSize: 1000,
+}
+
+// Analyse a parsed subscription expression before it is used. The
+// expression is rejected with a *ParseError if it exceeds the limits
+// (ErrorsNestingTooDeep for depth, ErrorsImplementationLimit for size
+// and ErrorsRegexpTooComplex for a costly pattern) or if it is always
+// true or never true (ErrorsExpIsTrivial). Otherwise constant sub-expressions are folded,
+// modifying the AST in place, and the new root is returned.
+func Analyse(ast *AST, limits ExpressionLimits) (*AST, error) {
+	nodes := 0
+	if err := checkLimits(ast, 1, &nodes, limits); err != nil {
+		return nil, err
+	}
+
+	ast, constant := fold(ast)
+	if constant {
+		return nil, &ParseError{ErrorsExpIsTrivial, []interface{}{}}
+	}
+	return ast, nil
+}
+
+// Check a subscription expression as a router would, without any
+// limits, returning a *ParseError with the error code and offset if
+// it's rejected. A router may still refuse an expression that passes
+// if it exceeds the router's limits, and may accept one calling a
+// function registered with the router but unknown here.
+func ValidateExpression(expr string) error {
+	var parser Parser
+	ast, err := parser.Parse(expr)
+	if err != nil {
+		return err
+	}
+	_, err = Analyse(ast, ExpressionLimits{})
+	return err
+}
+
+// Walk the tree checking limits, stopping at the first one exceeded
+func checkLimits(node *AST, depth int, nodes *int, limits ExpressionLimits) error {
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		return &ParseError{ErrorsNestingTooDeep, []interface{}{Format(node), int32(node.offset)}}
+	}
+	*nodes++
+	if limits.MaxNodes > 0 && *nodes > limits.MaxNodes {
+		// The size is of the whole expression so there's no position
+		return &ParseError{ErrorsImplementationLimit, []interface{}{}}
+	}
+
+	// Patterns are compiled by the parser so that's already
+	// bounded, but a large program is costly for every notification
+	if limits.MaxRegexpSize > 0 {
+		for i, re := range node.matchers {
+			if regexpSize(re.String()) > limits.MaxRegexpSize {
+				pattern := node.Children[i+1]
+				return &ParseError{ErrorsRegexpTooComplex, []interface{}{pattern.Value, int32(pattern.offset)}}
+			}
+		}
+	}
+
+	for _, child := range node.Children {
+		if err := checkLimits(child, depth+1, nodes, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number of instructions in a regular expression's program
+func regexpSize(expr string) int {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0
+	}
+	return len(prog.Inst)
+}
+
+// Fold constant sub-expressions returning the replacement node and
+// whether it is constant. A constant predicate is left as a node
+// whose Eval() gives its value and the logical operators only
+// simplify where that leaves their result unchanged for every
+// notification, including those where an operand is bottom.
+func fold(node *AST) (*AST, bool) {
+	switch node.TypeCode {
+	case LogicalAndTypeCode:
+		return foldList(node, LukTrue, LukFalse)
+
+	case LogicalOrTypeCode:
+		return foldList(node, LukFalse, LukTrue)
+
+	case LogicalExclusiveOrTypeCode:
+		return foldXor(node)
+
+	case NameTypeCode, FuncRequireTypeCode,
+		FuncInt32TypeCode, FuncInt64TypeCode, FuncReal64TypeCode,
+		FuncStringTypeCode, FuncOpaqueTypeCode, FuncNanTypeCode,
+		FuncCustomTypeCode:
+		// These depend on the notification regardless of operands,
+		// or in the case of custom functions may depend on anything
+		return node, false
+	}
+
+	constant := true
+	bottom := false
+	for i, child := range node.Children {
+		var c bool
+		node.Children[i], c = fold(child)
+		constant = constant && c
+		bottom = bottom || c && isBottom(node.Children[i])
+	}
+
+	// The remaining operators and functions are bottom if any
+	// operand is, so one that's always bottom makes the node
+	// constant whatever else it depends on
+	if bottom {
+		return node, true
+	}
+	if !constant || isPredicate(node) {
+		return node, constant
+	}
+
+	// A constant value becomes a literal unless it's bottom
+	if literal := literalNode(node.value(nil), node.offset); literal != nil {
+		return literal, true
+	}
+	return node, true
+}
+
+// Fold a conjunction or disjunction. Operands that always evaluate
+// to the identity are dropped while one evaluating to the absorbing
+// value decides the result.
+func foldList(node *AST, identity int, absorbing int) (*AST, bool) {
+	var children []*AST
+	constant := true
+	for _, child := range node.Children {
+		child, c := fold(child)
+		if c {
+			switch child.Eval(nil) {
+			case absorbing:
+				return child, true
+			case identity:
+				continue
+			}
+		}
+		constant = constant && c
+		children = append(children, child)
+	}
+
+	switch len(children) {
+	case 0:
+		// Only identities so the node is constant
+		return node, true
+	case 1:
+		return children[0], constant
+	}
+	node.Children = children
+	return node, constant
+}
+
+// Fold an exclusive or. A bottom operand decides the result, false
+// operands are dropped and each true operand inverts the rest.
+func foldXor(node *AST) (*AST, bool) {
+	var children []*AST
+	invert := false
+	for i, child := range node.Children {
+		child, c := fold(child)
+		node.Children[i] = child
+		if c {
+			switch child.Eval(nil) {
+			case LukBottom:
+				return child, true
+			case LukTrue:
+				invert = !invert
+			}
+			continue
+		}
+		children = append(children, child)
+	}
+
+	switch len(children) {
+	case 0:
+		return node, true
+	case 1:
+		node = children[0]
+	default:
+		node = &AST{TypeCode: LogicalExclusiveOrTypeCode, Children: children, offset: node.offset}
+	}
+	if invert {
+		node = &AST{TypeCode: LogicalNotTypeCode, Children: []*AST{node}, offset: node.offset}
+	}
+	return node, false
+}
+
+// Is a node evaluated with Eval() rather than value()
+func isPredicate(node *AST) bool {
+	switch node.TypeCode {
+	case LogicalOrTypeCode, LogicalExclusiveOrTypeCode, LogicalAndTypeCode, LogicalNotTypeCode,
+		EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode,
+		LessThanOrEqualsTypeCode, GreaterThanTypeCode, GreaterThanOrEqualsTypeCode:
+		return true
+	}
+	return node.function != nil && node.function.Predicate != nil
+}
+
+// Does a constant node always evaluate to bottom
+func isBottom(node *AST) bool {
+	if isPredicate(node) {
+		return node.Eval(nil) == LukBottom
+	}
+	return node.value(nil) == nil
+}
+
+// A constant node holding a value, or nil if it has no literal form
+func literalNode(v interface{}, offset int) *AST {
+	var typeCode int
+	switch v.(type) {
+	case int32:
+		typeCode = Int32TypeCode
+	case int64:
+		typeCode = Int64TypeCode
+	case float64:
+		typeCode = Real64TypeCode
+	case string:
+		typeCode = StringTypeCode
+	default:
+		return nil
+	}
+	return &AST{TypeCode: typeCode, Value: v, BaseType: typeCode, offset: offset}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyseTrivial(t *testing.T) {
+	var parser Parser
+	tests := []string{
+		"1 == 1",
+		"1 == 2",
+		"1 == 'one'",
+		"1 / 0 == 1",
+		"!(1 == 2)",
+		"a == 1 || 1 == 1",
+		"a == 1 && 1 == 2",
+		"1 == 1 ^^ 2 == 2",
+		"a == 1 ^^ 1 == 'one'",
+		"begins-with('abc', 'a')",
+		"size(fold-case('ABC')) == 3",
+		"equals(1, 2, 3)",
+		"a == 1 / 0",
+		"a + 1 / 0 > b",
+		"!(size(a) < 1 % 0)",
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test, err)
+			continue
+		}
+		_, err = Analyse(ast, DefaultExpressionLimits)
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != ErrorsExpIsTrivial {
+			t.Errorf("Analyse(%s) returned %v, expected ErrorsExpIsTrivial", test, err)
+		}
+	}
+}
+
+func TestAnalyseFold(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"a == 1 + 2 * 3", "a == 7"},
+		{"a == ~0", "a == 0xffffffff"},
+		{"a < 1.5 * 2", "a < 3.0"},
+		{"a == 1 && 2 == 2", "a == 1"},
+		{"a == 1 || 1 == 2 || b == 2", "a == 1 || b == 2"},
+		{"a == 1 && (b == 1 || 1 == 1)", "a == 1"},
+		{"a == 1 ^^ 1 == 2", "a == 1"},
+		{"a == 1 ^^ 1 == 1", "!a == 1"},
+		{"a == 1 ^^ b == 2 ^^ 1 == 1", "!(a == 1 ^^ b == 2)"},
+		{"a == 1 && 1 == 'one'", "a == 1 && 1 == \"one\""},
+		{"a == 1 || 1 == 'one'", "a == 1 || 1 == \"one\""},
+		{"begins-with(a, 'x') && size(fold-case('AB')) < b", "begins-with(a, \"x\") && 2 < b"},
+		{"equals(a, 1 + 1, 'two')", "equals(a, 2, \"two\")"},
+		{"a == 1 / 0 || b == 2", "a == 1 / 0 || b == 2"},
+	}
+	nfns := []map[string]interface{}{
+		{},
+		{"a": int32(1)},
+		{"a": int32(7), "b": int32(2)},
+		{"a": int32(-1), "b": "two"},
+		{"a": "xyz", "b": int32(3)},
+		{"a": int32(2)},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		folded, err := Analyse(ast, DefaultExpressionLimits)
+		if err != nil {
+			t.Errorf("Analyse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		if Format(folded) != test.expected {
+			t.Errorf("Analyse(%s): expected %s got %s", test.expr, test.expected, Format(folded))
+		}
+
+		// Folding must never change the result
+		original, _ := parser.Parse(test.expr)
+		for _, nfn := range nfns {
+			if original.Eval(nfn) != folded.Eval(nfn) {
+				t.Errorf("Analyse(%s) changed the result for %v", test.expr, nfn)
+			}
+		}
+	}
+}
+
+func TestAnalyseLimits(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr   string
+		limits ExpressionLimits
+		code   uint16
+		offset int
+	}{
+		{"a == 1 || b + 1 + 1 == 1", ExpressionLimits{MaxDepth: 4}, ErrorsNestingTooDeep, 10},
+		{"a == 1 || b == 2 || c == 3", ExpressionLimits{MaxNodes: 6}, ErrorsImplementationLimit, 0},
+		{"a == 1 || regex(b, '(x{1,100}){1,10}')", ExpressionLimits{MaxRegexpSize: 1000}, ErrorsRegexpTooComplex, 19},
+		{"a == 1 || wildcard(b, '*x', '*******y')", ExpressionLimits{MaxRegexpSize: 16}, ErrorsRegexpTooComplex, 28},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		if _, err := Analyse(ast, ExpressionLimits{}); err != nil {
+			t.Errorf("Analyse(%s) without limits failed: %v", test.expr, err)
+		}
+		_, err = Analyse(ast, test.limits)
+		parseError, ok := err.(*ParseError)
+		if !ok || parseError.ErrorCode != test.code || parseError.Offset() != test.offset {
+			t.Errorf("Analyse(%s) returned %v, expected code %d at %d", test.expr, err, test.code, test.offset)
+		} else if strings.Contains(err.Error(), "%!") {
+			t.Errorf("Analyse(%s) returned badly formatted %v", test.expr, err)
+		}
+	}
+}
+
+func TestValidateExpression(t *testing.T) {
+	tests := []struct {
+		expr   string
+		code   uint16
+		offset int
+	}{
+		{"a == 1 || regex(b, 'x')", 0, 0},
+		{"a == 1 ||", ErrorsParsing, 9},
+		{"a == 'oops", ErrorsUnterminatedString, 5},
+		{"a == 1 && no-such(b)", ErrorsUnknownFunction, 10},
+		{"a == 1 && 1 == 2", ErrorsExpIsTrivial, 0},
+	}
+
+	for _, test := range tests {
+		err := ValidateExpression(test.expr)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("ValidateExpression(%s) failed: %v", test.expr, err)
+			}
+			continue
+		}
+		parseError, ok := err.(*ParseError)
+		if !ok || parseError.ErrorCode != test.code || parseError.Offset() != test.offset {
+			t.Errorf("ValidateExpression(%s) returned %v, expected code %d at %d", test.expr, err, test.code, test.offset)
+		}
+	}
+}
+
+// Folded expressions format to text that parses and folds back to
+// the same expression
+func TestAnalyseFormat(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"x < 1.0 / 0.0", "x < (1.0 / 0.0)"},
+		{"x < -1.0 / 0.0", "x < (-1.0 / 0.0)"},
+		{"x == 0.0 / 0.0", "x == (0.0 / 0.0)"},
+		{"x < +Inf", "x < +Inf"},
+		{"x == -2147483647 - 1", "x == 0x80000000"},
+		{"x == -9223372036854775807L - 1L", "x == 0x8000000000000000L"},
+		{"x == -2147483647 - 1 + 1", "x == 0x80000001"},
+		{"x == 0xffffffff", "x == 0xffffffff"},
+		{"x == 0xffffffffffffffffL", "x == 0xffffffffffffffffL"},
+		{"x == 017777777777 + 1", "x == 0x80000000"},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err == nil {
+			ast, err = Analyse(ast, ExpressionLimits{})
+		}
+		if err != nil {
+			t.Errorf("Analyse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		formatted := Format(ast)
+		if formatted != test.expected {
+			t.Errorf("Format(Analyse(%s)) is %s, expected %s", test.expr, formatted, test.expected)
+		}
+
+		ast, err = parser.Parse(formatted)
+		if err == nil {
+			ast, err = Analyse(ast, ExpressionLimits{})
+		}
+		if err != nil {
+			t.Errorf("Analyse(%s) failed: %v", formatted, err)
+		} else if Format(ast) != formatted {
+			t.Errorf("Analyse(%s) is %s", formatted, Format(ast))
+		}
+	}
+}
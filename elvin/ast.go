@@ -20,6 +20,12 @@
 
 package elvin
 
+import (
+	"bytes"
+	"math"
+	"regexp"
+)
+
 const (
 	EmptyTypeCode               = 0
 	NameTypeCode                = 1
@@ -68,6 +74,9 @@ const (
 	FuncRequireTypeCode         = 64
 	FuncEqualsTypeCode          = 65
 	FuncSizeTypeCode            = 66
+
+	// Registered functions, which have no wire representation
+	FuncCustomTypeCode = 128
 )
 
 const (
@@ -76,26 +85,412 @@ const (
 	LukBottom = -1
 )
 
+// A node in a parsed subscription expression. Constants and names
+// carry their value in Value, while operators and functions carry
+// their operands (or arguments) in Children.
 type AST struct {
 	TypeCode int
 	Value    interface{}
 	ID       int
 	BaseType int
+	Children []*AST
+
+	function *Function        // Of a function call
+	matchers []*regexp.Regexp // Compiled wildcard and regex patterns
+	offset   int              // Of the node's text in the parsed expression
 }
 
-func (node *AST) match(n map[string]interface{}) bool {
-	return node.eval(n) == LukTrue
+// Does a notification match the expression rooted at this node
+func (node *AST) Match(n map[string]interface{}) bool {
+	return node.Eval(n) == LukTrue
 }
 
-func (node *AST) eval(n map[string]interface{}) int {
+// Evaluate the expression rooted at this node as a predicate over a
+// notification, returning LukTrue, LukFalse or LukBottom. Missing
+// attributes and type mismatches evaluate to LukBottom which then
+// propagates through the logical operators as per Lukasiewicz's
+// three-valued logic.
+func (node *AST) Eval(n map[string]interface{}) int {
 	switch node.TypeCode {
-	case FuncRequireTypeCode:
-		name := node.Value.(string)
-		if _, ok := n[name]; !ok {
-			return LukBottom
+	case LogicalOrTypeCode:
+		result := LukFalse
+		for _, child := range node.Children {
+			switch child.Eval(n) {
+			case LukTrue:
+				return LukTrue
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+
+	case LogicalAndTypeCode:
+		result := LukTrue
+		for _, child := range node.Children {
+			switch child.Eval(n) {
+			case LukFalse:
+				return LukFalse
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+
+	case LogicalExclusiveOrTypeCode:
+		result := LukFalse
+		for _, child := range node.Children {
+			switch child.Eval(n) {
+			case LukTrue:
+				result = LukTrue - result
+			case LukBottom:
+				return LukBottom
+			}
+		}
+		return result
+
+	case LogicalNotTypeCode:
+		switch node.Children[0].Eval(n) {
+		case LukTrue:
+			return LukFalse
+		case LukFalse:
+			return LukTrue
+		}
+		return LukBottom
+
+	case EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode,
+		LessThanOrEqualsTypeCode, GreaterThanTypeCode, GreaterThanOrEqualsTypeCode:
+		return compare(node.TypeCode, node.Children[0].value(n), node.Children[1].value(n))
+
+	default:
+		if node.function != nil && node.function.Predicate != nil {
+			if args := node.arguments(n); args != nil {
+				return node.function.Predicate(args)
+			}
+		}
+	}
+
+	return LukBottom
+}
+
+// Evaluate the expression rooted at this node as a value. Returns
+// nil (bottom) for missing attributes, type mismatches and nodes that
+// are predicates rather than values.
+func (node *AST) value(n map[string]interface{}) interface{} {
+	switch node.TypeCode {
+	case Int32TypeCode, Int64TypeCode, Real64TypeCode, StringTypeCode:
+		return node.Value
+
+	case NameTypeCode:
+		return n[node.Value.(string)]
+
+	case UnaryPlusTypeCode:
+		v := node.Children[0].value(n)
+		if numericType(v) == EmptyTypeCode {
+			return nil
 		}
+		return v
+
+	case UnaryMinusTypeCode:
+		switch v := node.Children[0].value(n).(type) {
+		case int32:
+			return -v
+		case int64:
+			return -v
+		case float64:
+			return -v
+		}
+		return nil
+
+	case BinaryNotTypeCode:
+		switch v := node.Children[0].value(n).(type) {
+		case int32:
+			return ^v
+		case int64:
+			return ^v
+		}
+		return nil
+
+	case MultiplyTypeCode, DivideTypeCode, ModuloTypeCode, AddTypeCode, SubtractTypeCode:
+		return arithmetic(node.TypeCode, node.Children[0].value(n), node.Children[1].value(n))
+
+	case ShiftLeftTypeCode, ShiftRightTypeCode, LogicalShiftRightTypeCode:
+		return shift(node.TypeCode, node.Children[0].value(n), node.Children[1].value(n))
+
+	case BinaryAndTypeCode, BinaryExclusiveOrTypeCode, BinaryOrTypeCode:
+		return bitwise(node.TypeCode, node.Children[0].value(n), node.Children[1].value(n))
+
+	default:
+		if node.function != nil && node.function.Value != nil {
+			if args := node.arguments(n); args != nil {
+				return node.function.Value(args)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Convert a go boolean into a Lukasiewicz value
+func lukBool(b bool) int {
+	if b {
 		return LukTrue
 	}
+	return LukFalse
+}
+
+// The numeric type code of a value, or EmptyTypeCode if not numeric.
+// Note that the codes are ordered such that the larger of two is the
+// type both should be promoted to.
+func numericType(v interface{}) int {
+	switch v.(type) {
+	case int32:
+		return Int32TypeCode
+	case int64:
+		return Int64TypeCode
+	case float64:
+		return Real64TypeCode
+	}
+	return EmptyTypeCode
+}
+
+// The type both values are promoted to for a numeric operation
+func promotedType(a, b interface{}) int {
+	ta, tb := numericType(a), numericType(b)
+	if ta == EmptyTypeCode || tb == EmptyTypeCode {
+		return EmptyTypeCode
+	}
+	if ta > tb {
+		return ta
+	}
+	return tb
+}
+
+// Widen a numeric value to an int64
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// Widen a numeric value to a float64
+func toFloat64(v interface{}) float64 {
+	switch v := v.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// Compare two values. Strings compare only with strings and opaques
+// only with opaques (for equality), while numbers are promoted.
+func compare(typeCode int, left, right interface{}) int {
+	if left == nil || right == nil {
+		return LukBottom
+	}
+
+	switch l := left.(type) {
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return LukBottom
+		}
+		switch typeCode {
+		case EqualsTypeCode:
+			return lukBool(l == r)
+		case NotEqualsTypeCode:
+			return lukBool(l != r)
+		}
+		return LukBottom
+
+	case []byte:
+		r, ok := right.([]byte)
+		if !ok {
+			return LukBottom
+		}
+		switch typeCode {
+		case EqualsTypeCode:
+			return lukBool(bytes.Equal(l, r))
+		case NotEqualsTypeCode:
+			return lukBool(!bytes.Equal(l, r))
+		}
+		return LukBottom
+	}
+
+	switch promotedType(left, right) {
+	case Int32TypeCode, Int64TypeCode:
+		l, r := toInt64(left), toInt64(right)
+		switch typeCode {
+		case EqualsTypeCode:
+			return lukBool(l == r)
+		case NotEqualsTypeCode:
+			return lukBool(l != r)
+		case LessThanTypeCode:
+			return lukBool(l < r)
+		case LessThanOrEqualsTypeCode:
+			return lukBool(l <= r)
+		case GreaterThanTypeCode:
+			return lukBool(l > r)
+		case GreaterThanOrEqualsTypeCode:
+			return lukBool(l >= r)
+		}
+
+	case Real64TypeCode:
+		l, r := toFloat64(left), toFloat64(right)
+		switch typeCode {
+		case EqualsTypeCode:
+			return lukBool(l == r)
+		case NotEqualsTypeCode:
+			return lukBool(l != r)
+		case LessThanTypeCode:
+			return lukBool(l < r)
+		case LessThanOrEqualsTypeCode:
+			return lukBool(l <= r)
+		case GreaterThanTypeCode:
+			return lukBool(l > r)
+		case GreaterThanOrEqualsTypeCode:
+			return lukBool(l >= r)
+		}
+	}
 
 	return LukBottom
 }
+
+// Arithmetic over promoted numeric values. Integer arithmetic wraps
+// on overflow and integer division by zero is bottom.
+func arithmetic(typeCode int, left, right interface{}) interface{} {
+	switch promotedType(left, right) {
+	case Int32TypeCode:
+		l, r := left.(int32), right.(int32)
+		switch typeCode {
+		case MultiplyTypeCode:
+			return l * r
+		case DivideTypeCode:
+			if r == 0 {
+				return nil
+			}
+			return l / r
+		case ModuloTypeCode:
+			if r == 0 {
+				return nil
+			}
+			return l % r
+		case AddTypeCode:
+			return l + r
+		case SubtractTypeCode:
+			return l - r
+		}
+
+	case Int64TypeCode:
+		l, r := toInt64(left), toInt64(right)
+		switch typeCode {
+		case MultiplyTypeCode:
+			return l * r
+		case DivideTypeCode:
+			if r == 0 {
+				return nil
+			}
+			return l / r
+		case ModuloTypeCode:
+			if r == 0 {
+				return nil
+			}
+			return l % r
+		case AddTypeCode:
+			return l + r
+		case SubtractTypeCode:
+			return l - r
+		}
+
+	case Real64TypeCode:
+		l, r := toFloat64(left), toFloat64(right)
+		switch typeCode {
+		case MultiplyTypeCode:
+			return l * r
+		case DivideTypeCode:
+			return l / r
+		case ModuloTypeCode:
+			return math.Mod(l, r)
+		case AddTypeCode:
+			return l + r
+		case SubtractTypeCode:
+			return l - r
+		}
+	}
+
+	return nil
+}
+
+// Shifts apply only to integers, the result having the type of the
+// left operand. As in Java, the shift distance is masked to the width
+// of that type.
+func shift(typeCode int, left, right interface{}) interface{} {
+	if numericType(right) != Int32TypeCode && numericType(right) != Int64TypeCode {
+		return nil
+	}
+	distance := uint(toInt64(right))
+
+	switch l := left.(type) {
+	case int32:
+		distance &= 31
+		switch typeCode {
+		case ShiftLeftTypeCode:
+			return l << distance
+		case ShiftRightTypeCode:
+			return l >> distance
+		case LogicalShiftRightTypeCode:
+			return int32(uint32(l) >> distance)
+		}
+
+	case int64:
+		distance &= 63
+		switch typeCode {
+		case ShiftLeftTypeCode:
+			return l << distance
+		case ShiftRightTypeCode:
+			return l >> distance
+		case LogicalShiftRightTypeCode:
+			return int64(uint64(l) >> distance)
+		}
+	}
+
+	return nil
+}
+
+// Bitwise operators apply only to (promoted) integers
+func bitwise(typeCode int, left, right interface{}) interface{} {
+	switch promotedType(left, right) {
+	case Int32TypeCode:
+		l, r := left.(int32), right.(int32)
+		switch typeCode {
+		case BinaryAndTypeCode:
+			return l & r
+		case BinaryExclusiveOrTypeCode:
+			return l ^ r
+		case BinaryOrTypeCode:
+			return l | r
+		}
+
+	case Int64TypeCode:
+		l, r := toInt64(left), toInt64(right)
+		switch typeCode {
+		case BinaryAndTypeCode:
+			return l & r
+		case BinaryExclusiveOrTypeCode:
+			return l ^ r
+		case BinaryOrTypeCode:
+			return l | r
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+)
+
+var evalNotification = map[string]interface{}{
+	"i32":    int32(42),
+	"i64":    int64(1) << 40,
+	"r64":    2.5,
+	"neg":    int32(-8),
+	"zero":   int32(0),
+	"str":    "foo",
+	"opaque": []byte{1, 2, 3},
+	"same":   []byte{1, 2, 3},
+}
+
+type evalTest struct {
+	expr   string
+	result int
+}
+
+func runEvalTests(t *testing.T, tests []evalTest) {
+	var parser Parser
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		if result := ast.Eval(evalNotification); result != test.result {
+			t.Errorf("Eval(%s): expected %d, got %d", test.expr, test.result, result)
+		}
+	}
+}
+
+func TestEvalComparisons(t *testing.T) {
+	runEvalTests(t, []evalTest{
+		{"i32 == 42", LukTrue},
+		{"i32 != 42", LukFalse},
+		{"i32 < 43", LukTrue},
+		{"i32 <= 42", LukTrue},
+		{"i32 > 42", LukFalse},
+		{"i32 >= 43", LukFalse},
+		{"str == 'foo'", LukTrue},
+		{"str != 'bar'", LukTrue},
+		{"opaque == same", LukTrue},
+		{"opaque != same", LukFalse},
+		{"missing == 1", LukBottom},
+		{"missing != 1", LukBottom},
+		{"str == 1", LukBottom},
+		{"str < i32", LukBottom},
+		{"opaque == 'foo'", LukBottom},
+	})
+}
+
+func TestEvalPromotion(t *testing.T) {
+	runEvalTests(t, []evalTest{
+		{"i32 == 42L", LukTrue},
+		{"i32 == 42.0", LukTrue},
+		{"i64 > i32", LukTrue},
+		{"r64 > 2", LukTrue},
+		{"r64 < 3L", LukTrue},
+		{"i32 + 0.5 == 42.5", LukTrue},
+		{"i32 + 1L == 43", LukTrue},
+	})
+}
+
+func TestEvalLogical(t *testing.T) {
+	runEvalTests(t, []evalTest{
+		{"i32 == 42 || missing == 1", LukTrue},
+		{"i32 == 0 || missing == 1", LukBottom},
+		{"i32 == 0 || str == 'bar'", LukFalse},
+		{"i32 == 42 && missing == 1", LukBottom},
+		{"i32 == 0 && missing == 1", LukFalse},
+		{"i32 == 42 && str == 'foo'", LukTrue},
+		{"i32 == 42 ^^ str == 'foo'", LukFalse},
+		{"i32 == 42 ^^ str == 'bar'", LukTrue},
+		{"i32 == 42 ^^ missing == 1", LukBottom},
+		{"!(i32 == 42)", LukFalse},
+		{"!(i32 == 0)", LukTrue},
+		{"!(missing == 0)", LukBottom},
+		{"require(i32)", LukTrue},
+		{"require(missing)", LukBottom},
+	})
+}
+
+func TestEvalArithmetic(t *testing.T) {
+	runEvalTests(t, []evalTest{
+		{"i32 + 8 == 50", LukTrue},
+		{"i32 - 2 == 40", LukTrue},
+		{"i32 * 2 == 84", LukTrue},
+		{"i32 / 5 == 8", LukTrue},
+		{"i32 % 5 == 2", LukTrue},
+		{"r64 / 2 == 1.25", LukTrue},
+		{"i32 / zero == 1", LukBottom},
+		{"i32 % zero == 1", LukBottom},
+		{"-i32 == -42", LukTrue},
+		{"+i32 == 42", LukTrue},
+		{"+str == 42", LukBottom},
+		{"str + 1 == 2", LukBottom},
+		{"missing + 1 == 2", LukBottom},
+	})
+}
+
+func TestEvalBitwise(t *testing.T) {
+	runEvalTests(t, []evalTest{
+		{"i32 & 15 == 10", LukTrue},
+		{"i32 | 1 == 43", LukTrue},
+		{"i32 ^ 2 == 40", LukTrue},
+		{"~zero == -1", LukTrue},
+		{"1 << 4 == 16", LukTrue},
+		{"neg >> 1 == -4", LukTrue},
+		{"neg >>> 28 == 15", LukTrue},
+		{"i64 >> 40 == 1", LukTrue},
+		{"r64 & 1 == 0", LukBottom},
+		{"~r64 == 0", LukBottom},
+		{"r64 << 1 == 5", LukBottom},
+	})
+}
@@ -45,7 +45,7 @@ import (
 type Client struct {
 	URL      string                 // Router descriptor
 	Protocol *Protocol              // Router specification
-	Options  map[string]interface{} // Router options
+	Options  map[string]interface{} // Connection options to request
 	KeysNfn  KeyBlock               // Connections keys for outgoing notifications
 	KeysSub  KeyBlock               // Connections keys for incoming notifications
 	Events   chan Packet            // Clients may listen here for connectionq events
@@ -61,6 +61,7 @@ type Client struct {
 	writeTerminate chan int
 	mu             sync.Mutex
 	wg             sync.WaitGroup
+	options        map[string]interface{} // Negotiated with the router
 
 	// Maps of all current subscriptions used for mapping
 	// NotifyDelivers and for maintaining subscriptions across
@@ -74,6 +75,9 @@ type Client struct {
 	quenchReplies map[uint32]*Quench // map QuenchAdd/Mod/Del/Nack
 	quenches      map[int64]*Quench  // All our quenches
 
+	// Outstanding SecRequests
+	secReplies map[uint32]chan Packet // map SecReply/Nack
+
 	// Connection level packets
 	connReplies chan Packet // receive ConnReply, DisconnReply, DropWarn
 	connXID     uint32      // XID of any outstanding connrqst
@@ -87,6 +91,7 @@ const DisconnectTimeout = (10 * time.Second)
 const SubscriptionTimeout = (10 * time.Second)
 const QuenchTimeout = (10 * time.Second)
 const TestConnTimeout = (10 * time.Second)
+const SecurityTimeout = (10 * time.Second)
 
 // Transaction IDs on packets
 func XID() uint32 {
@@ -126,19 +131,26 @@ type Subscription struct {
 	events chan Packet // synchronous replies
 }
 
+// Keep the subscription's keys as the router holds them once it has
+// accepted a SubModRequest
 func (sub *Subscription) addKeys(keys KeyBlock) {
-	// FIXME: implement
-	return
+	if len(keys) > 0 {
+		sub.Keys = changeKeys(sub.Keys, keys, nil)
+	}
 }
 
 func (sub *Subscription) delKeys(keys KeyBlock) {
-	// FIXME: implement
-	return
+	if len(keys) > 0 {
+		sub.Keys = changeKeys(sub.Keys, nil, keys)
+	}
 }
 
+// Delivered on a Quench's Notifications channel for each SubAddNotify,
+// SubModNotify and SubDelNotify. A term that is added or modified
+// carries its expression while a deleted one carries nil.
 type QuenchNotification struct {
 	TermID  uint64
-	SubExpr SubAST
+	SubExpr *AST
 }
 
 // The Quench type used by clients.
@@ -151,14 +163,18 @@ type Quench struct {
 	events          chan Packet             // synchronous replies
 }
 
+// Keep the quench's keys as the router holds them once it has
+// accepted a QuenchModRequest
 func (quench *Quench) addKeys(keys KeyBlock) {
-	// FIXME: implement
-	return
+	if len(keys) > 0 {
+		quench.Keys = changeKeys(quench.Keys, keys, nil)
+	}
 }
 
 func (quench *Quench) delKeys(keys KeyBlock) {
-	// FIXME: implement
-	return
+	if len(keys) > 0 {
+		quench.Keys = changeKeys(quench.Keys, nil, keys)
+	}
 }
 
 // Create a new client.
@@ -174,6 +190,7 @@ func NewClient(url string, options map[string]interface{}, keysNfn KeyBlock, key
 	client.writeTerminate = make(chan int)
 	client.subscriptions = make(map[int64]*Subscription)
 	client.quenches = make(map[int64]*Quench)
+	client.secReplies = make(map[uint32]chan Packet)
 	// Sync Packets
 	client.connReplies = make(chan Packet)
 	client.subReplies = make(map[uint32]*Subscription)
@@ -255,6 +272,7 @@ func (client *Client) close() {
 	// client.readTerminate <- 1
 	client.subReplies = make(map[uint32]*Subscription)
 	client.quenchReplies = make(map[uint32]*Quench)
+	client.secReplies = make(map[uint32]chan Packet)
 	client.connXID = 0
 	client.disconnXID = 0
 	client.mu.Unlock()
@@ -306,11 +324,17 @@ func (client *Client) Connect() (err error) {
 			if connReply.XID != pkt.XID {
 				err = LocalError(ErrorsMismatchedXIDs, pkt.XID, connReply.XID)
 			} else {
-				// FIXME: Options check/save?
+				client.mu.Lock()
+				client.options = connReply.Options
+				client.mu.Unlock()
 				client.SetState(StateConnected)
 			}
 		case *Nack:
-			client.SetState(StateClosed)
+			client.mu.Lock()
+			client.options = nil
+			client.mu.Unlock()
+			// Refused, so close the connection for another Connect() to reopen
+			client.close()
 			err = NackError(*reply.(*Nack))
 		default:
 			client.SetState(StateClosed)
@@ -323,6 +347,21 @@ func (client *Client) Connect() (err error) {
 	return err
 }
 
+// The connection options negotiated with the router, such as
+// Subscription.Max-Count, as returned in its ConnReply
+func (client *Client) ConnectionOptions() map[string]interface{} {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.options == nil {
+		return nil
+	}
+	options := make(map[string]interface{})
+	for name, v := range client.options {
+		options[name] = v
+	}
+	return options
+}
+
 // Disonnect this client from it's endpoint
 func (client *Client) Disconnect() (err error) {
 
@@ -384,6 +423,69 @@ func (client *Client) TestConn() (err error) {
 
 }
 
+// Change the connection's keys without reconnecting. Notification
+// keys are added and deleted from those used for every notification
+// sent, and subscription keys from those used for every notification
+// received. On success the client's KeysNfn and KeysSub are updated
+// so that a reconnection uses the same keys.
+func (client *Client) SetConnectionKeys(addNfn, delNfn, addSub, delSub KeyBlock) (err error) {
+	if client.State() != StateConnected {
+		return LocalError(ErrorsClientNotConnected)
+	}
+
+	pkt := new(SecRequest)
+	pkt.AddNfnKeys = addNfn
+	pkt.DelNfnKeys = delNfn
+	pkt.AddSubKeys = addSub
+	pkt.DelSubKeys = delSub
+
+	writeBuf := new(bytes.Buffer)
+	xID := pkt.Encode(writeBuf)
+
+	// Map the XID back to this request
+	replies := make(chan Packet, 1)
+	client.mu.Lock()
+	client.secReplies[xID] = replies
+	client.mu.Unlock()
+
+	client.writeChannel <- writeBuf
+
+	// Wait for the reply
+	select {
+	case reply := <-replies:
+		switch reply.(type) {
+		case *SecReply:
+			client.mu.Lock()
+			client.KeysNfn = changeKeys(client.KeysNfn, addNfn, delNfn)
+			client.KeysSub = changeKeys(client.KeysSub, addSub, delSub)
+			client.mu.Unlock()
+		case *Nack:
+			err = NackError(*reply.(*Nack))
+		default:
+			err = LocalError(ErrorsBadPacket)
+		}
+
+	case <-time.After(SecurityTimeout):
+		err = LocalError(ErrorsTimeout)
+	}
+
+	client.mu.Lock()
+	delete(client.secReplies, xID)
+	client.mu.Unlock()
+
+	return err
+}
+
+// Return a copy of a KeyBlock that may be nil with keys added and
+// deleted. Nothing is shared with the original or the added keys, so
+// a KeyBlock already handed out is never changed.
+func changeKeys(keys, add, del KeyBlock) KeyBlock {
+	keys = KeyBlockCopy(keys)
+	KeyBlockAddKeys(keys, KeyBlockCopy(add))
+	KeyBlockDeleteKeys(keys, del)
+	return keys
+}
+
 // Send a notification
 func (client *Client) Notify(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (err error) {
 
@@ -442,9 +544,26 @@ func (client *Client) UNotify(nv map[string]interface{}, deliverInsecure bool, k
 	return nil
 }
 
-// Subscribe this client to the subscription
+// Validate a subscription expression before sending it to the
+// router. Functions unknown here are left for the router to judge as
+// it may have its own registered.
+func validateSubscription(expr string) error {
+	if err := ValidateExpression(expr); err != nil {
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != ErrorsUnknownFunction {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe this client to the subscription. An invalid expression
+// is rejected locally with a *ParseError.
 func (client *Client) Subscribe(sub *Subscription) (err error) {
 
+	if err = validateSubscription(sub.Expression); err != nil {
+		return err
+	}
+
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
@@ -498,9 +617,16 @@ func (client *Client) Subscribe(sub *Subscription) (err error) {
 // If the expression is empty ("") it will remain unchanged
 // Similarly the keysets to add and delete may be empty. It is not an
 // error if the added keys already exist or to delete keys that do not
-// already exist
+// already exist. An invalid expression is rejected locally with a
+// *ParseError.
 func (client *Client) SubscriptionModify(sub *Subscription, expr string, acceptInsecure bool, AddKeys KeyBlock, DelKeys KeyBlock) (err error) {
 
+	if len(expr) > 0 {
+		if err = validateSubscription(expr); err != nil {
+			return err
+		}
+	}
+
 	if client.State() != StateConnected {
 		return LocalError(ErrorsClientNotConnected)
 	}
@@ -620,6 +746,7 @@ func (client *Client) Quench(quench *Quench) (err error) {
 	pkt.DeliverInsecure = quench.DeliverInsecure
 	pkt.Keys = quench.Keys
 
+	quench.quenchID = 0
 	quench.events = make(chan Packet)
 
 	writeBuf := new(bytes.Buffer)
@@ -637,12 +764,7 @@ func (client *Client) Quench(quench *Quench) (err error) {
 	case reply := <-quench.events:
 		switch reply.(type) {
 		case *QuenchReply:
-			quenchReply := reply.(*QuenchReply)
-			// Track the quench id
-			quench.quenchID = quenchReply.QuenchID
-			client.mu.Lock()
-			client.quenches[quench.quenchID] = quench
-			client.mu.Unlock()
+			// The quench id is tracked by handleQuenchReply
 		case *Nack:
 			err = NackError(*reply.(*Nack))
 		default:
@@ -936,6 +1058,8 @@ func (client *Client) handlePacket(buffer []byte) (err error) {
 			return client.handleSubDelNotify(buffer)
 		case PacketDropWarn:
 			return client.handleDropWarn(buffer)
+		case PacketSecReply:
+			return client.handleSecReply(buffer)
 		default:
 			return LocalError(ErrorsProtocolPacketStateIsConnected, PacketIDString(PacketID(buffer)))
 		}
@@ -995,6 +1119,8 @@ func (client *Client) ConnectionEventsDefault(event Packet) {
 		}
 	case *DropWarn:
 		client.elog.Logf(elog.LogLevelWarning, "DropWarn (lost one or more packets)")
+	case *Nack:
+		client.elog.Logf(elog.LogLevelWarning, "Notification rejected: %v", event)
 
 	default:
 		client.elog.Logf(elog.LogLevelError, "FIXME: bad connection notification")
@@ -1163,6 +1289,17 @@ func (client *Client) handleNack(buffer []byte) (err error) {
 		client.ProtocolError(err)
 	}
 
+	// A Nack without an XID is for a request that has none, such
+	// as a notification, and is signalled like a DropWarn
+	if nack.XID == 0 {
+		select {
+		case client.Events <- nack:
+		default:
+			go client.ConnectionEventsDefault(nack)
+		}
+		return nil
+	}
+
 	// A Nack can belong to multiple places so hunt it down
 	client.mu.Lock()
 	defer client.mu.Unlock()
@@ -1181,6 +1318,13 @@ func (client *Client) handleNack(buffer []byte) (err error) {
 		return nil
 	}
 
+	replies, ok := client.secReplies[nack.XID]
+	if ok {
+		delete(client.secReplies, nack.XID)
+		replies <- Packet(nack)
+		return nil
+	}
+
 	if client.connXID == nack.XID {
 		client.connXID = 0
 		client.connReplies <- Packet(nack)
@@ -1208,6 +1352,24 @@ func (client *Client) handleSubReply(buffer []byte) (err error) {
 	return nil
 }
 
+// Handle a Security reply
+func (client *Client) handleSecReply(buffer []byte) (err error) {
+	secReply := new(SecReply)
+	if err = secReply.Decode(buffer); err != nil {
+		client.ProtocolError(err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	replies, ok := client.secReplies[secReply.XID]
+	if ok {
+		// Signal the requestor
+		delete(client.secReplies, secReply.XID)
+		replies <- Packet(secReply)
+	} // else it will time out
+	return nil
+}
+
 // Handle a Qeunch reply
 func (client *Client) handleQuenchReply(buffer []byte) (err error) {
 	quenchReply := new(QuenchReply)
@@ -1217,9 +1379,17 @@ func (client *Client) handleQuenchReply(buffer []byte) (err error) {
 
 	client.mu.Lock()
 	quench, ok := client.quenchReplies[quenchReply.XID]
-	client.mu.Unlock()
 	if ok {
 		delete(client.quenchReplies, quenchReply.XID)
+		// Track a new quench before the next packet is read as the
+		// router may follow the reply with SubAddNotifies for it
+		if quench.quenchID == 0 {
+			quench.quenchID = quenchReply.QuenchID
+			client.quenches[quench.quenchID] = quench
+		}
+	}
+	client.mu.Unlock()
+	if ok {
 		quench.events <- Packet(quenchReply)
 	} // else it will time out
 	return nil
@@ -1337,8 +1507,7 @@ func (client *Client) handleSubDelNotify(buffer []byte) (err error) {
 	quenches := client.quenches
 	client.mu.Unlock()
 
-	// FIXME: AST is mock (should be empty for delete)
-	notification := QuenchNotification{subDelNotify.TermID, SubAST{1}}
+	notification := QuenchNotification{subDelNotify.TermID, nil}
 	for _, quenchID := range subDelNotify.QuenchIDs {
 		client.elog.Logf(elog.LogLevelDebug3, "QuenchDelNotify for %d", quenchID)
 		quench, ok := quenches[quenchID]
@@ -0,0 +1,421 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+// A compiled subscription expression. It returns LukTrue, LukFalse or
+// LukBottom for a notification exactly as the AST's Eval() would.
+type Predicate func(n map[string]interface{}) int
+
+// A compiled value, nil being bottom as for value()
+type valueFunc func(n map[string]interface{}) interface{}
+
+// A function given each predicate sub-expression while compiling along
+// with a function to compile it. It returns the predicate to use in
+// its place, which need not call compile if it has an equivalent.
+type ShareFunc func(node *AST, compile func() Predicate) Predicate
+
+// Compile the expression rooted at this node into a tree of closures.
+// Each closure is specialised for its node when compiled so that
+// evaluation avoids the interpreter's type code dispatch: constants
+// are boxed and converted once, attribute names are bound directly
+// into their lookups, functions are bound to their Predicate or Value
+// and the common comparison of an attribute with a constant is
+// handled without going through interfaces.
+func (node *AST) Compile() Predicate {
+	return node.CompileShared(nil)
+}
+
+// Compile the expression passing each predicate sub-expression,
+// including this node, to share (if not nil) so that a caller can
+// substitute predicates compiled for other expressions.
+func (node *AST) CompileShared(share ShareFunc) Predicate {
+	if share == nil {
+		return node.compile(nil)
+	}
+	return share(node, func() Predicate {
+		return node.compile(share)
+	})
+}
+
+// Compile this node, sharing any predicate operands
+func (node *AST) compile(share ShareFunc) Predicate {
+	switch node.TypeCode {
+	case LogicalOrTypeCode:
+		return compileOr(compileAll(node.Children, share))
+
+	case LogicalAndTypeCode:
+		return compileAnd(compileAll(node.Children, share))
+
+	case LogicalExclusiveOrTypeCode:
+		children := compileAll(node.Children, share)
+		return func(n map[string]interface{}) int {
+			result := LukFalse
+			for _, child := range children {
+				switch child(n) {
+				case LukTrue:
+					result = LukTrue - result
+				case LukBottom:
+					return LukBottom
+				}
+			}
+			return result
+		}
+
+	case LogicalNotTypeCode:
+		child := node.Children[0].CompileShared(share)
+		return func(n map[string]interface{}) int {
+			switch child(n) {
+			case LukTrue:
+				return LukFalse
+			case LukFalse:
+				return LukTrue
+			}
+			return LukBottom
+		}
+
+	case EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode,
+		LessThanOrEqualsTypeCode, GreaterThanTypeCode, GreaterThanOrEqualsTypeCode:
+		return compileComparison(node)
+
+	default:
+		if node.function != nil && node.function.Predicate != nil {
+			predicate, args := node.function.Predicate, compileArguments(node)
+			return func(n map[string]interface{}) int {
+				if values := args(n); values != nil {
+					return predicate(values)
+				}
+				return LukBottom
+			}
+		}
+	}
+
+	return func(n map[string]interface{}) int {
+		return LukBottom
+	}
+}
+
+// Compile each of a node's children
+func compileAll(nodes []*AST, share ShareFunc) []Predicate {
+	predicates := make([]Predicate, len(nodes))
+	for i, node := range nodes {
+		predicates[i] = node.CompileShared(share)
+	}
+	return predicates
+}
+
+// Disjunctions, with the common two operand case unrolled
+func compileOr(children []Predicate) Predicate {
+	if len(children) == 2 {
+		left, right := children[0], children[1]
+		return func(n map[string]interface{}) int {
+			l := left(n)
+			if l == LukTrue {
+				return LukTrue
+			}
+			r := right(n)
+			if r == LukTrue {
+				return LukTrue
+			}
+			if l == LukBottom || r == LukBottom {
+				return LukBottom
+			}
+			return LukFalse
+		}
+	}
+	return func(n map[string]interface{}) int {
+		result := LukFalse
+		for _, child := range children {
+			switch child(n) {
+			case LukTrue:
+				return LukTrue
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+	}
+}
+
+// Conjunctions, with the common two operand case unrolled
+func compileAnd(children []Predicate) Predicate {
+	if len(children) == 2 {
+		left, right := children[0], children[1]
+		return func(n map[string]interface{}) int {
+			l := left(n)
+			if l == LukFalse {
+				return LukFalse
+			}
+			r := right(n)
+			if r == LukFalse {
+				return LukFalse
+			}
+			if l == LukBottom || r == LukBottom {
+				return LukBottom
+			}
+			return LukTrue
+		}
+	}
+	return func(n map[string]interface{}) int {
+		result := LukTrue
+		for _, child := range children {
+			switch child(n) {
+			case LukFalse:
+				return LukFalse
+			case LukBottom:
+				result = LukBottom
+			}
+		}
+		return result
+	}
+}
+
+// The comparison with its operands swapped
+var swappedComparisons = map[int]int{
+	EqualsTypeCode:              EqualsTypeCode,
+	NotEqualsTypeCode:           NotEqualsTypeCode,
+	LessThanTypeCode:            GreaterThanTypeCode,
+	LessThanOrEqualsTypeCode:    GreaterThanOrEqualsTypeCode,
+	GreaterThanTypeCode:         LessThanTypeCode,
+	GreaterThanOrEqualsTypeCode: LessThanOrEqualsTypeCode,
+}
+
+// Is a node a literal constant
+func isLiteral(node *AST) bool {
+	switch node.TypeCode {
+	case Int32TypeCode, Int64TypeCode, Real64TypeCode, StringTypeCode:
+		return true
+	}
+	return false
+}
+
+// Compile a comparison, specialising an attribute compared with a
+// constant (in either order) and otherwise comparing the values
+func compileComparison(node *AST) Predicate {
+	typeCode := node.TypeCode
+	left, right := node.Children[0], node.Children[1]
+
+	if left.TypeCode == NameTypeCode && isLiteral(right) {
+		return compareAttribute(typeCode, left.Value.(string), right.Value)
+	}
+	if right.TypeCode == NameTypeCode && isLiteral(left) {
+		return compareAttribute(swappedComparisons[typeCode], right.Value.(string), left.Value)
+	}
+
+	l, r := left.compileValue(), right.compileValue()
+	return func(n map[string]interface{}) int {
+		return compare(typeCode, l(n), r(n))
+	}
+}
+
+// Compare an attribute with a constant. The constant is converted up
+// front to each type the attribute's value might be promoted to.
+func compareAttribute(typeCode int, name string, constant interface{}) Predicate {
+	if s, ok := constant.(string); ok {
+		equal := typeCode == EqualsTypeCode
+		if !equal && typeCode != NotEqualsTypeCode {
+			// Strings are unordered
+			return func(n map[string]interface{}) int {
+				return LukBottom
+			}
+		}
+		return func(n map[string]interface{}) int {
+			v, ok := n[name].(string)
+			if !ok {
+				return LukBottom
+			}
+			return lukBool((v == s) == equal)
+		}
+	}
+
+	i, f := toInt64(constant), toFloat64(constant)
+	if numericType(constant) == Real64TypeCode {
+		return func(n map[string]interface{}) int {
+			switch v := n[name].(type) {
+			case int32:
+				return compareFloat64(typeCode, float64(v), f)
+			case int64:
+				return compareFloat64(typeCode, float64(v), f)
+			case float64:
+				return compareFloat64(typeCode, v, f)
+			}
+			return LukBottom
+		}
+	}
+	return func(n map[string]interface{}) int {
+		switch v := n[name].(type) {
+		case int32:
+			return compareInt64(typeCode, int64(v), i)
+		case int64:
+			return compareInt64(typeCode, v, i)
+		case float64:
+			return compareFloat64(typeCode, v, f)
+		}
+		return LukBottom
+	}
+}
+
+// Compare two integers
+func compareInt64(typeCode int, l, r int64) int {
+	switch typeCode {
+	case EqualsTypeCode:
+		return lukBool(l == r)
+	case NotEqualsTypeCode:
+		return lukBool(l != r)
+	case LessThanTypeCode:
+		return lukBool(l < r)
+	case LessThanOrEqualsTypeCode:
+		return lukBool(l <= r)
+	case GreaterThanTypeCode:
+		return lukBool(l > r)
+	case GreaterThanOrEqualsTypeCode:
+		return lukBool(l >= r)
+	}
+	return LukBottom
+}
+
+// Compare two reals
+func compareFloat64(typeCode int, l, r float64) int {
+	switch typeCode {
+	case EqualsTypeCode:
+		return lukBool(l == r)
+	case NotEqualsTypeCode:
+		return lukBool(l != r)
+	case LessThanTypeCode:
+		return lukBool(l < r)
+	case LessThanOrEqualsTypeCode:
+		return lukBool(l <= r)
+	case GreaterThanTypeCode:
+		return lukBool(l > r)
+	case GreaterThanOrEqualsTypeCode:
+		return lukBool(l >= r)
+	}
+	return LukBottom
+}
+
+// Compile the expression rooted at this node as a value
+func (node *AST) compileValue() valueFunc {
+	switch node.TypeCode {
+	case Int32TypeCode, Int64TypeCode, Real64TypeCode, StringTypeCode:
+		v := node.Value
+		return func(n map[string]interface{}) interface{} {
+			return v
+		}
+
+	case NameTypeCode:
+		name := node.Value.(string)
+		return func(n map[string]interface{}) interface{} {
+			return n[name]
+		}
+
+	case UnaryPlusTypeCode:
+		child := node.Children[0].compileValue()
+		return func(n map[string]interface{}) interface{} {
+			v := child(n)
+			if numericType(v) == EmptyTypeCode {
+				return nil
+			}
+			return v
+		}
+
+	case UnaryMinusTypeCode:
+		child := node.Children[0].compileValue()
+		return func(n map[string]interface{}) interface{} {
+			switch v := child(n).(type) {
+			case int32:
+				return -v
+			case int64:
+				return -v
+			case float64:
+				return -v
+			}
+			return nil
+		}
+
+	case BinaryNotTypeCode:
+		child := node.Children[0].compileValue()
+		return func(n map[string]interface{}) interface{} {
+			switch v := child(n).(type) {
+			case int32:
+				return ^v
+			case int64:
+				return ^v
+			}
+			return nil
+		}
+
+	case MultiplyTypeCode, DivideTypeCode, ModuloTypeCode, AddTypeCode, SubtractTypeCode:
+		return compileBinary(node, arithmetic)
+
+	case ShiftLeftTypeCode, ShiftRightTypeCode, LogicalShiftRightTypeCode:
+		return compileBinary(node, shift)
+
+	case BinaryAndTypeCode, BinaryExclusiveOrTypeCode, BinaryOrTypeCode:
+		return compileBinary(node, bitwise)
+
+	default:
+		if node.function != nil && node.function.Value != nil {
+			value, args := node.function.Value, compileArguments(node)
+			return func(n map[string]interface{}) interface{} {
+				if values := args(n); values != nil {
+					return value(values)
+				}
+				return nil
+			}
+		}
+	}
+
+	return func(n map[string]interface{}) interface{} {
+		return nil
+	}
+}
+
+// Compile a function's arguments into a function returning their
+// values, or nil if any is bottom, just as arguments() would
+func compileArguments(node *AST) func(n map[string]interface{}) []interface{} {
+	children := make([]valueFunc, len(node.Children))
+	for i, child := range node.Children {
+		if re, ok := node.pattern(i); ok {
+			children[i] = func(n map[string]interface{}) interface{} {
+				return re
+			}
+		} else {
+			children[i] = child.compileValue()
+		}
+	}
+	return func(n map[string]interface{}) []interface{} {
+		values := make([]interface{}, len(children))
+		for i, child := range children {
+			if values[i] = child(n); values[i] == nil {
+				return nil
+			}
+		}
+		return values
+	}
+}
+
+// Compile a binary value operator evaluated by op
+func compileBinary(node *AST, op func(typeCode int, left, right interface{}) interface{}) valueFunc {
+	typeCode := node.TypeCode
+	left, right := node.Children[0].compileValue(), node.Children[1].compileValue()
+	return func(n map[string]interface{}) interface{} {
+		return op(typeCode, left(n), right(n))
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"math"
+	"testing"
+)
+
+var compileExprs = []string{
+	"i32 == 42", "i32 != 42", "i32 < 43", "42 <= i32", "i32 > 41.5", "i32 >= 42L",
+	"i64 == 1099511627776L", "i64 > i32", "r64 < 3", "2 > r64", "r64 == 2.5", "nan != 1",
+	"str == 'foo'", "'foo' != str", "str < ('z')", "str == 1", "opaque == same", "opaque != 'x'",
+	"missing == 1", "missing != 'x'", "i32 + 0.5 == 42.5", "i32 / zero == 1", "-i32 == -42",
+	"+str == 1", "~i32 == -43", "i32 << 2 == 168", "i64 >>> 40 == 1L", "i32 & 15 | 1 ^ 2 == 11",
+	"i32 == 42 || missing == 1", "i32 == 0 || missing == 1", "i32 == 0 || str == 'bar'",
+	"i32 == 42 && missing == 1", "i32 == 0 && missing == 1", "i32 == 42 && str == 'foo'",
+	"i32 == 42 || str == 'x' || missing == 1", "i32 == 42 && str == 'foo' && missing == 1",
+	"i32 == 42 ^^ str == 'foo'", "i32 == 42 ^^ missing == 1", "!(i32 == 42)", "!(missing == 0)",
+	"require(i32)", "require(missing)", "int32(i32)", "int64(i32)", "real64(r64)", "string(str)",
+	"opaque(opaque)", "nan(nan)", "nan(r64)", "nan(str)", "int32(missing)",
+	"begins-with(str, 'f', 'x')", "contains(fold-case(upper), 'oo')", "ends-with(str, 'x')",
+	"begins-with(i32, '4')", "wildcard(str, 'f*', '?')", "regex(decompose(accent), '^e')",
+	"regex(decompose-compat(accent), 'x')", "size(str) == 3", "size(opaque) == 3L", "size(i32) == 1",
+	"equals(i32, 1, 42L)", "equals(str, 'bar', 'foo')", "equals(r64, 1, 2)", "equals(missing, 1)",
+	"fold-case(street) == 'strasse'",
+}
+
+var compileNotifications = []map[string]interface{}{
+	{},
+	{
+		"i32":    int32(42),
+		"i64":    int64(1) << 40,
+		"r64":    2.5,
+		"nan":    math.NaN(),
+		"zero":   int32(0),
+		"str":    "foo",
+		"upper":  "FOO",
+		"accent": "é",
+		"street": "Straße",
+		"opaque": []byte{1, 2, 3},
+		"same":   []byte{1, 2, 3},
+	},
+	{"i32": int64(42), "i64": int32(1), "r64": int32(2), "str": []byte("foo"), "opaque": "foo"},
+	{"i32": 42.0, "i64": 1.5, "r64": "2.5", "str": "bar", "nan": int32(1)},
+	{"i32": int32(-1), "str": "", "zero": 0.0, "upper": int32(1)},
+}
+
+func TestCompile(t *testing.T) {
+	var parser Parser
+	for _, expr := range compileExprs {
+		ast, err := parser.Parse(expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", expr, err)
+			continue
+		}
+		predicate := ast.Compile()
+		for i, nfn := range compileNotifications {
+			if expected, result := ast.Eval(nfn), predicate(nfn); result != expected {
+				t.Errorf("Compiled %s: expected %d got %d for notification %d", expr, expected, result, i)
+			}
+		}
+	}
+}
+
+// Realistic subscriptions, mostly conjunctions of attribute tests
+var benchmarkExprs = []string{
+	"Group == 'ops' && Severity > 3",
+	"require(Host) && begins-with(Host, 'web', 'db') && Load >= 2.5",
+	"Group == 'ops' || Group == 'dev' || Group == 'qa'",
+	"equals(Service, 'http', 'https', 'ssh') && !(Port == 22)",
+	"contains(fold-case(Message), 'error') && Count + 1 > 10",
+}
+
+var benchmarkNotification = map[string]interface{}{
+	"Group":    "ops",
+	"Severity": int32(4),
+	"Host":     "web07",
+	"Load":     3.25,
+	"Service":  "https",
+	"Port":     int32(443),
+	"Message":  "Disk ERROR on /var",
+	"Count":    int64(12),
+}
+
+func benchmarkAsts(b *testing.B) []*AST {
+	var parser Parser
+	var asts []*AST
+	for _, expr := range benchmarkExprs {
+		ast, err := parser.Parse(expr)
+		if err != nil {
+			b.Fatalf("Parse(%s) failed: %v", expr, err)
+		}
+		asts = append(asts, ast)
+	}
+	return asts
+}
+
+func BenchmarkEvalInterpreted(b *testing.B) {
+	asts := benchmarkAsts(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ast := range asts {
+			ast.Eval(benchmarkNotification)
+		}
+	}
+}
+
+func BenchmarkEvalCompiled(b *testing.B) {
+	var predicates []Predicate
+	for _, ast := range benchmarkAsts(b) {
+		predicates = append(predicates, ast.Compile())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, predicate := range predicates {
+			predicate(benchmarkNotification)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Precedence of each kind of node as it appears in the grammar,
+// loosest first
+const (
+	precOr = iota + 1
+	precXor
+	precAnd
+	precBool  // Comparisons and !
+	precValue // String constants
+	precBitOr
+	precBitXor
+	precBitAnd
+	precShift
+	precSum
+	precProduct
+	precUnary // Constants, names, functions and unary operators
+)
+
+// Operator spellings and precedence by type code
+var operators = map[int]struct {
+	symbol     string
+	precedence int
+}{
+	LogicalOrTypeCode:           {"||", precOr},
+	LogicalExclusiveOrTypeCode:  {"^^", precXor},
+	LogicalAndTypeCode:          {"&&", precAnd},
+	LogicalNotTypeCode:          {"!", precBool},
+	EqualsTypeCode:              {"==", precBool},
+	NotEqualsTypeCode:           {"!=", precBool},
+	LessThanTypeCode:            {"<", precBool},
+	LessThanOrEqualsTypeCode:    {"<=", precBool},
+	GreaterThanTypeCode:         {">", precBool},
+	GreaterThanOrEqualsTypeCode: {">=", precBool},
+	BinaryOrTypeCode:            {"|", precBitOr},
+	BinaryExclusiveOrTypeCode:   {"^", precBitXor},
+	BinaryAndTypeCode:           {"&", precBitAnd},
+	ShiftLeftTypeCode:           {"<<", precShift},
+	ShiftRightTypeCode:          {">>", precShift},
+	LogicalShiftRightTypeCode:   {">>>", precShift},
+	AddTypeCode:                 {"+", precSum},
+	SubtractTypeCode:            {"-", precSum},
+	MultiplyTypeCode:            {"*", precProduct},
+	DivideTypeCode:              {"/", precProduct},
+	ModuloTypeCode:              {"%", precProduct},
+	UnaryPlusTypeCode:           {"+", precUnary},
+	UnaryMinusTypeCode:          {"-", precUnary},
+	BinaryNotTypeCode:           {"~", precUnary},
+}
+
+// The expression rooted at this node in canonical form
+func (node *AST) String() string {
+	return Format(node)
+}
+
+// Format an AST as canonical subscription syntax: single spaces
+// around binary operators, double quoted strings and only the
+// parentheses needed so that parsing the result yields the same tree.
+func Format(ast *AST) string {
+	if ast == nil {
+		return ""
+	}
+	var b strings.Builder
+	format(&b, ast)
+	return b.String()
+}
+
+// The precedence of a node
+func precedence(node *AST) int {
+	if node.TypeCode == StringTypeCode {
+		return precValue
+	}
+	if op, ok := operators[node.TypeCode]; ok {
+		return op.precedence
+	}
+	return precUnary
+}
+
+// Format a child, parenthesised if its precedence is below min
+func formatOperand(b *strings.Builder, node *AST, min int) {
+	if precedence(node) < min {
+		b.WriteString("(")
+		format(b, node)
+		b.WriteString(")")
+		return
+	}
+	format(b, node)
+}
+
+func format(b *strings.Builder, node *AST) {
+	switch node.TypeCode {
+	case NameTypeCode:
+		formatName(b, node.Value.(string))
+		return
+	case StringTypeCode:
+		formatString(b, node.Value.(string))
+		return
+	case Int32TypeCode:
+		// Literals have no sign so negative values are written as
+		// their hex bit pattern, which parses back to the same value
+		if i := node.Value.(int32); i < 0 {
+			b.WriteString("0x")
+			b.WriteString(strconv.FormatUint(uint64(uint32(i)), 16))
+		} else {
+			b.WriteString(strconv.FormatInt(int64(i), 10))
+		}
+		return
+	case Int64TypeCode:
+		if i := node.Value.(int64); i < 0 {
+			b.WriteString("0x")
+			b.WriteString(strconv.FormatUint(uint64(i), 16))
+		} else {
+			b.WriteString(strconv.FormatInt(i, 10))
+		}
+		b.WriteString("L")
+		return
+	case Real64TypeCode:
+		formatReal(b, node.Value.(float64))
+		return
+	}
+
+	if name, ok := functionName(node); ok {
+		b.WriteString(name)
+		b.WriteString("(")
+		for i, arg := range node.Children {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			formatOperand(b, arg, precValue)
+		}
+		b.WriteString(")")
+		return
+	}
+
+	op, ok := operators[node.TypeCode]
+	if !ok {
+		return
+	}
+
+	switch node.TypeCode {
+	case LogicalOrTypeCode, LogicalExclusiveOrTypeCode, LogicalAndTypeCode:
+		// Nested lists of the same operator need parentheses or
+		// they'd be flattened
+		for i, child := range node.Children {
+			if i > 0 {
+				b.WriteString(" " + op.symbol + " ")
+			}
+			formatOperand(b, child, op.precedence+1)
+		}
+
+	case LogicalNotTypeCode:
+		b.WriteString(op.symbol)
+		formatOperand(b, node.Children[0], precBool)
+
+	case UnaryPlusTypeCode, UnaryMinusTypeCode, BinaryNotTypeCode:
+		b.WriteString(op.symbol)
+		formatOperand(b, node.Children[0], precUnary)
+
+	case EqualsTypeCode, NotEqualsTypeCode:
+		// Comparisons don't associate and only equality takes strings
+		formatOperand(b, node.Children[0], precValue)
+		b.WriteString(" " + op.symbol + " ")
+		formatOperand(b, node.Children[1], precValue)
+
+	case LessThanTypeCode, LessThanOrEqualsTypeCode, GreaterThanTypeCode, GreaterThanOrEqualsTypeCode:
+		formatOperand(b, node.Children[0], precBitOr)
+		b.WriteString(" " + op.symbol + " ")
+		formatOperand(b, node.Children[1], precBitOr)
+
+	default:
+		// Left associative binary operators
+		formatOperand(b, node.Children[0], op.precedence)
+		b.WriteString(" " + op.symbol + " ")
+		formatOperand(b, node.Children[1], op.precedence+1)
+	}
+}
+
+// Names are escaped with backslashes where they contain characters
+// that would otherwise end them
+func formatName(b *strings.Builder, name string) {
+	for i, r := range name {
+		if (i == 0 && !isInitialNameChar(r)) || !isNameChar(r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+}
+
+// Strings are double quoted with backslash escapes
+func formatString(b *strings.Builder, s string) {
+	b.WriteRune('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString("\\n")
+		case '\t':
+			b.WriteString("\\t")
+		case '\r':
+			b.WriteString("\\r")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteRune('"')
+}
+
+// Reals always carry a point or exponent so they read back as reals.
+// Folding can produce infinities and NaN, which have no literal, so
+// they're written as the division that makes them.
+func formatReal(b *strings.Builder, f float64) {
+	switch {
+	case math.IsInf(f, 1):
+		b.WriteString("(1.0 / 0.0)")
+		return
+	case math.IsInf(f, -1):
+		b.WriteString("(-1.0 / 0.0)")
+		return
+	case math.IsNaN(f):
+		b.WriteString("(0.0 / 0.0)")
+		return
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	s = strings.Replace(s, "e+", "e", 1)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	b.WriteString(s)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+)
+
+// Do two trees have the same shape and values
+func sameTree(a, b *AST) bool {
+	if a.TypeCode != b.TypeCode || a.Value != b.Value || a.BaseType != b.BaseType ||
+		len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Children {
+		if !sameTree(a.Children[i], b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFormat(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"a  ==\t1", "a == 1"},
+		{"  a   ==  'x' ", "a == \"x\""},
+		{"(a == 1)", "a == 1"},
+		{"a == 1 || b == 2 && c == 3", "a == 1 || b == 2 && c == 3"},
+		{"(a == 1 || b == 2) && c == 3", "(a == 1 || b == 2) && c == 3"},
+		{"a == 1 && (b == 2 && c == 3)", "a == 1 && (b == 2 && c == 3)"},
+		{"(a == 1 && b == 2) && c == 3", "a == 1 && b == 2 && c == 3"},
+		{"a == 1 ^^ b == 2 || c == 3", "a == 1 ^^ b == 2 || c == 3"},
+		{"a == 1 ^^ (b == 2 || c == 3)", "a == 1 ^^ (b == 2 || c == 3)"},
+		{"!(a == 1)", "!a == 1"},
+		{"!(a == 1 && b == 2)", "!(a == 1 && b == 2)"},
+		{"!!require(a)", "!!require(a)"},
+		{"a + b * c == 1", "a + b * c == 1"},
+		{"(a + b) * c == 1", "(a + b) * c == 1"},
+		{"a - (b - c) == 1", "a - (b - c) == 1"},
+		{"(a - b) - c == 1", "a - b - c == 1"},
+		{"-(a + 1) < ~b", "-(a + 1) < ~b"},
+		{"-a * +b >= --c", "-a * +b >= --c"},
+		{"a | b ^ c & d << 1 >> 2 >>> 3 != 0", "a | b ^ c & d << 1 >> 2 >>> 3 != 0"},
+		{"(a | b) & c == 0", "(a | b) & c == 0"},
+		{"a == 0xffffffff || b == 0xffffffffffffffffL", "a == 0xffffffff || b == 0xffffffffffffffffL"},
+		{"a == 037777777776 || b == 0x8000000000000000L", "a == 0xfffffffe || b == 0x8000000000000000L"},
+		{"a == 42L || b == 4.5 || c == 3.0 || d == 1e300", "a == 42L || b == 4.5 || c == 3.0 || d == 1e300"},
+		{"a == 'say \"hi\"\\\\'", "a == \"say \\\"hi\\\"\\\\\""},
+		{"\\1st == 1 || \\ spaced\\ name == 2", "\\1st == 1 || \\ spaced\\ name == 2"},
+		{"begins-with(fold-case(a), 'x', 'y')", "begins-with(fold-case(a), \"x\", \"y\")"},
+		{"size(a) + 1 > 2", "size(a) + 1 > 2"},
+		{"equals(a, 1, -2, 'three')", "equals(a, 1, -2, \"three\")"},
+		{"('a') < b", "(\"a\") < b"},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		formatted := Format(ast)
+		if formatted != test.expected {
+			t.Errorf("Format(%s): expected %s got %s", test.expr, test.expected, formatted)
+			continue
+		}
+
+		// And back again
+		ast2, err := parser.Parse(formatted)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", formatted, err)
+			continue
+		}
+		if !sameTree(ast, ast2) {
+			t.Errorf("Round trip of %s changed the tree", test.expr)
+		}
+		if ast2.String() != formatted {
+			t.Errorf("Round trip of %s changed the format to %s", test.expr, ast2.String())
+		}
+	}
+
+	if Format(nil) != "" {
+		t.Errorf("Format(nil) should be empty")
+	}
+}
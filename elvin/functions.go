@@ -0,0 +1,311 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+// The built-in functions. These are evaluated through Predicate or
+// Value just as custom functions are, the AST only knowing their type
+// codes for Format and the wire encoding.
+var builtinFunctions = []Function{
+	{Name: "require", Args: []int{ArgName}, Predicate: require, typeCode: FuncRequireTypeCode},
+	{Name: "begins-with", Args: []int{ArgString, ArgStringConstant}, Variadic: true, Predicate: matchStrings(strings.HasPrefix), typeCode: FuncBeginsWithTypeCode},
+	{Name: "contains", Args: []int{ArgString, ArgStringConstant}, Variadic: true, Predicate: matchStrings(strings.Contains), typeCode: FuncContainsTypeCode},
+	{Name: "ends-with", Args: []int{ArgString, ArgStringConstant}, Variadic: true, Predicate: matchStrings(strings.HasSuffix), typeCode: FuncEndsWithTypeCode},
+	{Name: "wildcard", Args: []int{ArgString, ArgStringConstant}, Variadic: true, Check: checkWildcard, Predicate: matchPatterns, typeCode: FuncWildcardTypeCode},
+	{Name: "regex", Args: []int{ArgString, ArgStringConstant}, Variadic: true, Check: checkRegex, Predicate: matchPatterns, typeCode: FuncRegexTypeCode},
+
+	{Name: "fold-case", Args: []int{ArgString}, BaseType: StringTypeCode, Value: normalise(foldCase), typeCode: FuncFoldCaseTypeCode},
+	{Name: "decompose", Args: []int{ArgString}, BaseType: StringTypeCode, Value: normalise(norm.NFD.String), typeCode: FuncDecomposeTypeCode},
+	{Name: "decompose-compat", Args: []int{ArgString}, BaseType: StringTypeCode, Value: normalise(norm.NFKD.String), typeCode: FuncDecomposeCompatTypeCode},
+
+	{Name: "int32", Args: []int{ArgName}, Predicate: hasType(func(v interface{}) bool { _, ok := v.(int32); return ok }), typeCode: FuncInt32TypeCode},
+	{Name: "int64", Args: []int{ArgName}, Predicate: hasType(func(v interface{}) bool { _, ok := v.(int64); return ok }), typeCode: FuncInt64TypeCode},
+	{Name: "real64", Args: []int{ArgName}, Predicate: hasType(func(v interface{}) bool { _, ok := v.(float64); return ok }), typeCode: FuncReal64TypeCode},
+	{Name: "string", Args: []int{ArgName}, Predicate: hasType(func(v interface{}) bool { _, ok := v.(string); return ok }), typeCode: FuncStringTypeCode},
+	{Name: "opaque", Args: []int{ArgName}, Predicate: hasType(func(v interface{}) bool { _, ok := v.([]byte); return ok }), typeCode: FuncOpaqueTypeCode},
+	{Name: "nan", Args: []int{ArgName}, Predicate: isNaN, typeCode: FuncNanTypeCode},
+	{Name: "size", Args: []int{ArgString}, BaseType: Int32TypeCode, Value: size, typeCode: FuncSizeTypeCode},
+	{Name: "equals", Args: []int{ArgAny, ArgConstant}, Variadic: true, Predicate: equals, typeCode: FuncEqualsTypeCode},
+}
+
+func init() {
+	for _, f := range builtinFunctions {
+		if err := registerFunction(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// A short description of a node's type for error reporting
+func typeName(node *AST) string {
+	switch node.TypeCode {
+	case NameTypeCode:
+		return "name"
+	case Int32TypeCode:
+		return "int32"
+	case Int64TypeCode:
+		return "int64"
+	case Real64TypeCode:
+		return "real64"
+	case StringTypeCode:
+		return "string"
+	}
+	if node.BaseType == StringTypeCode {
+		return "string"
+	}
+	return "expression"
+}
+
+// Could a node evaluate to a string
+func isStringValued(node *AST) bool {
+	return node.TypeCode == NameTypeCode || node.BaseType == StringTypeCode
+}
+
+// Is a node a constant, or an expression of only constants
+func isConstant(node *AST) bool {
+	switch node.TypeCode {
+	case Int32TypeCode, Int64TypeCode, Real64TypeCode, StringTypeCode:
+		return true
+	case UnaryPlusTypeCode, UnaryMinusTypeCode, BinaryNotTypeCode,
+		MultiplyTypeCode, DivideTypeCode, ModuloTypeCode, AddTypeCode, SubtractTypeCode,
+		ShiftLeftTypeCode, ShiftRightTypeCode, LogicalShiftRightTypeCode,
+		BinaryAndTypeCode, BinaryExclusiveOrTypeCode, BinaryOrTypeCode:
+		for _, child := range node.Children {
+			if !isConstant(child) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Create a type mismatch error
+func typeMismatch(node *AST, expected string) error {
+	return &ParseError{ErrorsTypeMismatch, []interface{}{typeName(node), expected, int32(0)}}
+}
+
+// Compile wildcard() patterns once here rather than for every notification
+func checkWildcard(node *AST) error {
+	for _, arg := range node.Children[1:] {
+		re, err := compilePattern(wildcardToRegexp(arg.Value.(string)), arg.Value.(string))
+		if err != nil {
+			return err
+		}
+		node.matchers = append(node.matchers, re)
+	}
+	return nil
+}
+
+// Compile regex() patterns once here rather than for every notification
+func checkRegex(node *AST) error {
+	for _, arg := range node.Children[1:] {
+		re, err := compilePattern(arg.Value.(string), arg.Value.(string))
+		if err != nil {
+			return err
+		}
+		node.matchers = append(node.matchers, re)
+	}
+	return nil
+}
+
+// Compile a regular expression mapping failures to Elvin errors
+func compilePattern(expr string, pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		code := uint16(ErrorsInvalidRegexp)
+		if syntaxErr, ok := err.(*syntax.Error); ok {
+			switch syntaxErr.Code {
+			case syntax.ErrLarge, syntax.ErrNestingDepth, syntax.ErrInvalidRepeatSize:
+				code = ErrorsRegexpTooComplex
+			}
+		}
+		return nil, &ParseError{code, []interface{}{pattern, int32(0)}}
+	}
+	return re, nil
+}
+
+// Translate a wildcard (glob) pattern into an anchored regular
+// expression. '*' matches any sequence, '?' any single character,
+// '[...]' a character class (negated with a leading '!' or '^') and
+// '\' escapes the following character.
+func wildcardToRegexp(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+			} else {
+				sb.WriteString(regexp.QuoteMeta("\\"))
+			}
+		case '[':
+			// Find the end of the class, a leading ']' being literal
+			end := i + 1
+			if end < len(runes) && (runes[end] == '!' || runes[end] == '^') {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end >= len(runes) {
+				// Unterminated so treat it literally
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			sb.WriteString("[")
+			class := runes[i+1 : end]
+			if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+				sb.WriteString("^")
+				class = class[1:]
+			}
+			for _, c := range class {
+				if c == '\\' || c == '[' || c == ']' {
+					sb.WriteRune('\\')
+				}
+				sb.WriteRune(c)
+			}
+			sb.WriteString("]")
+			i = end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// A string matching function, true if the subject matches any of
+// the patterns and bottom if the subject is not a string
+func matchStrings(test func(s, pattern string) bool) func(args []interface{}) int {
+	return func(args []interface{}) int {
+		subject, ok := args[0].(string)
+		if !ok {
+			return LukBottom
+		}
+		for _, pattern := range args[1:] {
+			if test(subject, pattern.(string)) {
+				return LukTrue
+			}
+		}
+		return LukFalse
+	}
+}
+
+// Evaluate wildcard() or regex(), which are passed their patterns
+// already compiled
+func matchPatterns(args []interface{}) int {
+	subject, ok := args[0].(string)
+	if !ok {
+		return LukBottom
+	}
+	for _, re := range args[1:] {
+		if re.(*regexp.Regexp).MatchString(subject) {
+			return LukTrue
+		}
+	}
+	return LukFalse
+}
+
+// One of the Unicode normalisation functions, returning nil (bottom)
+// if the argument is not a string
+func normalise(transform func(s string) string) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil
+		}
+		return transform(s)
+	}
+}
+
+// Apply full Unicode case folding, so that "STRASSE", "straße" and
+// "STRAẞE" all fold to "strasse" and final sigma folds like any other.
+// A Caser holds state so one is made for each call.
+func foldCase(s string) string {
+	return cases.Fold().String(s)
+}
+
+// Evaluate require(), only called when the attribute exists
+func require(args []interface{}) int {
+	return LukTrue
+}
+
+// One of the type predicates, true if the attribute has the tested
+// type. These are bottom if the attribute is missing.
+func hasType(test func(v interface{}) bool) func(args []interface{}) int {
+	return func(args []interface{}) int {
+		return lukBool(test(args[0]))
+	}
+}
+
+// Evaluate nan(), which is only defined for real64 values
+func isNaN(args []interface{}) int {
+	f, ok := args[0].(float64)
+	if !ok {
+		return LukBottom
+	}
+	return lukBool(math.IsNaN(f))
+}
+
+// Evaluate size(), the number of characters in a string or bytes in
+// an opaque
+func size(args []interface{}) interface{} {
+	switch v := args[0].(type) {
+	case string:
+		return int32(utf8.RuneCountInString(v))
+	case []byte:
+		return int32(len(v))
+	}
+	return nil
+}
+
+// Evaluate equals(), true if the first argument is equal to any of
+// the others. Constants of an incomparable type simply don't match.
+func equals(args []interface{}) int {
+	for _, c := range args[1:] {
+		if compare(EqualsTypeCode, args[0], c) == LukTrue {
+			return LukTrue
+		}
+	}
+	return LukFalse
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"math"
+	"testing"
+)
+
+var functionNotification = map[string]interface{}{
+	"GROUP":  "ops.network",
+	"text":   "The quick brown fox",
+	"path":   "/var/log/messages",
+	"number": int32(42),
+}
+
+func runFunctionTests(t *testing.T, nfn map[string]interface{}, tests []evalTest) {
+	var parser Parser
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		if result := ast.Eval(nfn); result != test.result {
+			t.Errorf("Eval(%s): expected %d, got %d", test.expr, test.result, result)
+		}
+	}
+}
+
+func TestStringFunctions(t *testing.T) {
+	runFunctionTests(t, functionNotification, []evalTest{
+		{"begins-with(GROUP, 'ops.')", LukTrue},
+		{"begins-with(GROUP, 'dev.')", LukFalse},
+		{"begins-with(GROUP, 'dev.', 'ops.')", LukTrue},
+		{"ends-with(path, 'messages')", LukTrue},
+		{"ends-with(path, '.log', '.txt')", LukFalse},
+		{"contains(text, 'brown')", LukTrue},
+		{"contains(text, 'red', 'green')", LukFalse},
+		{"begins-with(missing, 'ops.')", LukBottom},
+		{"begins-with(number, '4')", LukBottom},
+		{"begins-with(GROUP, 'ops.') && contains(text, 'fox')", LukTrue},
+	})
+}
+
+func TestWildcard(t *testing.T) {
+	runFunctionTests(t, functionNotification, []evalTest{
+		{"wildcard(path, '/var/log/*')", LukTrue},
+		{"wildcard(path, '/var/log/m?ssages')", LukTrue},
+		{"wildcard(path, '/var/*/[mn]essages')", LukTrue},
+		{"wildcard(path, '/var/*/[!m]essages')", LukFalse},
+		{"wildcard(path, '/var/log')", LukFalse},
+		{"wildcard(path, '*.txt', '*messages')", LukTrue},
+		{"wildcard(GROUP, 'ops.*')", LukTrue},
+		{"wildcard(GROUP, 'ops\\\\.*')", LukTrue},
+		{"wildcard(missing, '*')", LukBottom},
+	})
+}
+
+func TestRegex(t *testing.T) {
+	runFunctionTests(t, functionNotification, []evalTest{
+		{"regex(text, 'qu.ck')", LukTrue},
+		{"regex(text, '^quick')", LukFalse},
+		{"regex(text, '^quick', 'f[aeiou]x$')", LukTrue},
+		{"regex(number, '4')", LukBottom},
+	})
+}
+
+func TestFunctionErrors(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr string
+		code uint16
+	}{
+		{"begins-with(GROUP)", ErrorsTooFewArgs},
+		{"begins-with(GROUP, 42)", ErrorsTypeMismatch},
+		{"begins-with(42, 'foo')", ErrorsTypeMismatch},
+		{"contains(text, name)", ErrorsTypeMismatch},
+		{"regex(text, 'a(b')", ErrorsInvalidRegexp},
+		{"regex(text, 'a{1001}')", ErrorsRegexpTooComplex},
+		{"require(42)", ErrorsTypeMismatch},
+	}
+
+	for _, test := range tests {
+		_, err := parser.Parse(test.expr)
+		if err == nil {
+			t.Errorf("Parse(%s) succeeded", test.expr)
+			continue
+		}
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != test.code {
+			t.Errorf("Parse(%s) returned %v, expected code %d", test.expr, err, test.code)
+		}
+	}
+}
+
+func TestWildcardToRegexp(t *testing.T) {
+	tests := map[string]string{
+		"*.txt":  `(?s)^.*\.txt$`,
+		"a?c":    `(?s)^a.c$`,
+		"[!ab]*": `(?s)^[^ab].*$`,
+		"a\\*":   `(?s)^a\*$`,
+		"[abc":   `(?s)^\[abc$`,
+	}
+	for in, expect := range tests {
+		if out := wildcardToRegexp(in); out != expect {
+			t.Errorf("wildcardToRegexp(%s): expected %s, got %s", in, expect, out)
+		}
+	}
+}
+
+func TestNormalisationFunctions(t *testing.T) {
+	nfn := map[string]interface{}{
+		"name":     "MÜLLER",
+		"composed": "caf\u00e9",
+		"ligature": "ﬁle",
+		"street":   "STRAẞE",
+		"sigma":    "ΟΔΟΣ",
+		"final":    "οδος",
+		"number":   int32(42),
+	}
+	runFunctionTests(t, nfn, []evalTest{
+		{"fold-case(name) == 'müller'", LukTrue},
+		{"name == 'müller'", LukFalse},
+		{"fold-case(street) == 'strasse'", LukTrue},
+		{"fold-case(street) == fold-case('Straße')", LukTrue},
+		{"fold-case(sigma) == fold-case(final)", LukTrue},
+		{"fold-case(final) == 'οδοσ'", LukTrue},
+		{"decompose(composed) == 'cafe\u0301'", LukTrue},
+		{"decompose(composed) == composed", LukFalse},
+		{"decompose-compat(ligature) == 'file'", LukTrue},
+		{"decompose(ligature) == 'file'", LukFalse},
+		{"begins-with(fold-case(name), 'mü')", LukTrue},
+		{"contains(decompose(fold-case(composed)), 'e\u0301')", LukTrue},
+		{"fold-case(number) == '42'", LukBottom},
+		{"fold-case(missing) == 'x'", LukBottom},
+	})
+
+	var parser Parser
+	if _, err := parser.Parse("fold-case(42) == 'x'"); err == nil {
+		t.Errorf("fold-case(42) parsed")
+	}
+	if _, err := parser.Parse("fold-case(a, b) == 'x'"); err == nil {
+		t.Errorf("fold-case(a, b) parsed")
+	}
+}
+
+func TestTypeFunctions(t *testing.T) {
+	nfn := map[string]interface{}{
+		"i32":    int32(1),
+		"i64":    int64(1),
+		"r64":    1.5,
+		"nan":    math.NaN(),
+		"str":    "héllo",
+		"opaque": []byte{1, 2, 3, 4},
+	}
+	runFunctionTests(t, nfn, []evalTest{
+		{"int32(i32)", LukTrue},
+		{"int32(i64)", LukFalse},
+		{"int64(i64)", LukTrue},
+		{"real64(r64)", LukTrue},
+		{"real64(i32)", LukFalse},
+		{"string(str)", LukTrue},
+		{"string(opaque)", LukFalse},
+		{"opaque(opaque)", LukTrue},
+		{"int32(missing)", LukBottom},
+		{"nan(nan)", LukTrue},
+		{"nan(r64)", LukFalse},
+		{"nan(i32)", LukBottom},
+		{"size(str) == 5", LukTrue},
+		{"size(opaque) == 4", LukTrue},
+		{"size(i32) == 1", LukBottom},
+		{"size(missing) > 0", LukBottom},
+		{"size(fold-case(str)) == 5", LukTrue},
+		{"equals(i32, 3, 2, 1)", LukTrue},
+		{"equals(i32, 3, 2)", LukFalse},
+		{"equals(r64, 1, 1.5)", LukTrue},
+		{"equals(i64, -1, 'one', 1)", LukTrue},
+		{"equals(str, 'hello', 'héllo')", LukTrue},
+		{"equals(str, 1, 2)", LukFalse},
+		{"equals(missing, 1)", LukBottom},
+	})
+
+	var parser Parser
+	tests := []struct {
+		expr string
+		code uint16
+	}{
+		{"int32(1)", ErrorsTypeMismatch},
+		{"nan('x')", ErrorsTypeMismatch},
+		{"size(1) == 1", ErrorsTypeMismatch},
+		{"equals(i32)", ErrorsTooFewArgs},
+		{"equals(i32, i64)", ErrorsTypeMismatch},
+		{"int32()", ErrorsTooFewArgs},
+	}
+	for _, test := range tests {
+		_, err := parser.Parse(test.expr)
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != test.code {
+			t.Errorf("Parse(%s) returned %v, expected code %d", test.expr, err, test.code)
+		}
+	}
+}
@@ -133,6 +133,19 @@ func KeySetDeleteKey(keyset *KeySet, delete Key) {
 	return
 }
 
+// Copy a KeyBlock so that adding or deleting keys from the copy leaves
+// the original as it was
+func KeyBlockCopy(keys KeyBlock) KeyBlock {
+	c := make(KeyBlock)
+	for scheme, ksl := range keys {
+		c[scheme] = make(KeySetList, len(ksl))
+		for i, ks := range ksl {
+			c[scheme][i] = append(KeySet(nil), ks...)
+		}
+	}
+	return c
+}
+
 // Add the keys in the second KeyBlock to the existing
 // Duplicates are simple ignored.
 // The dual schemes have two keysets where producer and consumer have only one
@@ -206,10 +219,10 @@ func KeyBlockDeleteKeys(existing KeyBlock, del KeyBlock) {
 		case KeySchemeSha256Producer:
 			fallthrough
 		case KeySchemeSha256Consumer:
-			// If we don't have this scheme already then we can
-			// just copy it in, otherwise check every key
+			// If we don't have this scheme already then ignore
+			// otherwise check every key
 			if kslExisting, ok := existing[scheme]; !ok {
-				existing[scheme] = del[scheme]
+				continue
 			} else {
 				for _, keyDel := range kslDel[KeySetDualProducer] {
 					KeySetDeleteKey(&kslExisting[KeySetDualProducer], keyDel)
@@ -125,4 +125,28 @@ func TestKeyBlock(t *testing.T) {
 		t.Fatalf("KeyBlockDeleteKeys() failed: %v", b1)
 	}
 
+	// Test deleting keys from schemes we don't have
+	b2 = make(map[int]KeySetList)
+	b2[KeySchemeSha256Producer] = KeySetList{ks2}
+	b2[KeySchemeSha256Dual] = KeySetList{ks1, ks2}
+	KeyBlockDeleteKeys(b1, b2)
+	if len(b1) != 1 || len(b1[KeySchemeSha1Producer][KeySetProducer]) != 1 {
+		t.Fatalf("KeyBlockDeleteKeys() changed the block: %v", b1)
+	}
+}
+
+func TestKeyBlockCopy(t *testing.T) {
+	var ks KeySet
+	KeySetAddKey(&ks, []byte("foo"))
+	b1 := KeyBlock{KeySchemeSha256Dual: KeySetList{ks, ks}}
+
+	b2 := KeyBlockCopy(b1)
+	KeySetAddKey(&b2[KeySchemeSha256Dual][KeySetDualConsumer], []byte("bar"))
+	KeySetDeleteKey(&b2[KeySchemeSha256Dual][KeySetDualProducer], []byte("foo"))
+	if len(b1[KeySchemeSha256Dual][KeySetDualProducer]) != 1 || len(b1[KeySchemeSha256Dual][KeySetDualConsumer]) != 1 {
+		t.Fatalf("KeyBlockCopy() shared keys: %v", b1)
+	}
+	if len(b2[KeySchemeSha256Dual][KeySetDualProducer]) != 0 || len(b2[KeySchemeSha256Dual][KeySetDualConsumer]) != 2 {
+		t.Fatalf("KeyBlockCopy() failed: %v", b2)
+	}
 }
@@ -21,228 +21,290 @@
 package elvin
 
 import (
-	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-// Lexer states.
-const (
-	inLimbo = iota
-	inIdentifier
-	inSingleQuotedString
-	inDoubleQuotedString
-	inNumber
-)
-
-// Pseudo-terminal, used to report a lexing error to the parser.
-const terminalError = -1
-
-// Structure used to pass tokens to the parser.
+// Structure used to pass tokens to the parser. The offset is the
+// byte index of the token's first character within the expression.
 type tokenInfo struct {
+	token  int
+	value  string
+	offset int
+}
+
+// Operators and punctuation, longest first so that the first match
+// is the right one
+var punctuation = []struct {
+	text  string
 	token int
-	value string
+}{
+	{">>>", TerminalBIT_LSR},
+	{">>", TerminalBIT_SHR},
+	{"<<", TerminalBIT_SHL},
+	{"&&", TerminalAND},
+	{"||", TerminalOR},
+	{"^^", TerminalXOR},
+	{"==", TerminalEQ},
+	{"!=", TerminalNEQ},
+	{"<=", TerminalLE},
+	{">=", TerminalGE},
+	{"(", TerminalLPAREN},
+	{")", TerminalRPAREN},
+	{",", TerminalCOMMA},
+	{"&", TerminalBIT_AND},
+	{"~", TerminalNEG},
+	{"|", TerminalBIT_OR},
+	{"^", TerminalBIT_XOR},
+	{"<", TerminalLT},
+	{">", TerminalGT},
+	{"+", TerminalPLUS},
+	{"-", TerminalMINUS},
+	{"*", TerminalTIMES},
+	{"/", TerminalDIV},
+	{"%", TerminalMOD},
+	{"!", TerminalBANG},
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
-func isInitialNumberChar(r rune) bool {
-	return strings.ContainsRune("0123456789-", r)
+func isOctalDigit(c byte) bool {
+	return c >= '0' && c <= '7'
 }
 
-func isNumberChar(r rune) bool {
-	return strings.ContainsRune("0123456789-.eEIL", r)
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
+// Names start with a letter or underscore, anything else must be
+// escaped with a backslash
 func isInitialNameChar(r rune) bool {
-	return strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_", r)
+	return r == '_' || unicode.IsLetter(r)
 }
 
+// After the first character names may contain any printable ASCII
+// except space, quotes, backslash, parentheses and comma, as well as
+// Unicode letters, digits and combining marks
 func isNameChar(r rune) bool {
-	return !(r < 32 || r > 126 || strings.ContainsRune("\\()\"', ", r))
+	if r > 126 {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+	}
+	return !(r < 32 || strings.ContainsRune("\\()\"', ", r))
 }
 
-func Lexer(buf string) []tokenInfo {
-	var tokens []tokenInfo
-	var i = 0
-	var mode = 0
-	var tokenValue strings.Builder
-	var eof = false
+// Split an expression into tokens, ending with an EOF. A character
+// that cannot start a token, a malformed literal or a string without
+// its closing quote is reported as a *ParseError giving its offset.
+func Lexer(buf string) (tokens []tokenInfo, err error) {
+	for i := 0; ; {
+		r, size := utf8.DecodeRuneInString(buf[i:])
+		switch {
+		case size == 0:
+			return append(tokens, tokenInfo{TerminalEOF, "", i}), nil
 
-	for {
-		expr := buf[i:]
-		rune1, len1 := utf8.DecodeRuneInString(expr)
-		if rune1 == 65533 && len1 == 0 {
-			eof = true
-		}
-		rune2, len2 := utf8.DecodeRuneInString(expr[len1:])
-		rune3, _ := utf8.DecodeRuneInString(expr[len1+len2:])
-
-		s2 := string([]rune{rune1, rune2})
-		s3 := string([]rune{rune1, rune2, rune3})
-
-		if mode == inLimbo {
-			if rune1 == '\'' {
-				mode = inSingleQuotedString
-				tokenValue.Reset()
-			} else if rune1 == '"' {
-				mode = inDoubleQuotedString
-				tokenValue.Reset()
-			} else if s3 == ">>>" { // Must check before '>>' (below)
-				tokens = append(tokens, tokenInfo{TerminalBIT_LSR, ""})
-				i += 2
-			} else if s2 == ">>" {
-				tokens = append(tokens, tokenInfo{TerminalBIT_SHR, ""})
-				i += 1
-			} else if s2 == "<<" {
-				tokens = append(tokens, tokenInfo{TerminalBIT_SHL, ""})
-				i += 1
-			} else if s2 == "&&" {
-				tokens = append(tokens, tokenInfo{TerminalAND, ""})
-				i += 1
-			} else if s2 == "||" {
-				tokens = append(tokens, tokenInfo{TerminalOR, ""})
-				i += 1
-			} else if s2 == "^^" {
-				tokens = append(tokens, tokenInfo{TerminalXOR, ""})
-				i += 1
-			} else if s2 == "==" {
-				tokens = append(tokens, tokenInfo{TerminalEQ, ""})
-				i += 1
-			} else if s2 == "!=" {
-				tokens = append(tokens, tokenInfo{TerminalNEQ, ""})
-				i += 1
-			} else if s2 == "<=" {
-				tokens = append(tokens, tokenInfo{TerminalLE, ""})
-				i += 1
-			} else if s2 == ">=" {
-				tokens = append(tokens, tokenInfo{TerminalGE, ""})
-				i += 1
-			} else if rune1 == '\\' {
-				mode = inIdentifier
-				tokenValue.WriteRune(rune2)
-				i += len2 // +=1 at end of loop covers backslash; this is for the real rune
-			} else if rune1 == '(' {
-				tokens = append(tokens, tokenInfo{TerminalLPAREN, ""})
-			} else if rune1 == ')' {
-				tokens = append(tokens, tokenInfo{TerminalRPAREN, ""})
-			} else if rune1 == ',' {
-				tokens = append(tokens, tokenInfo{TerminalCOMMA, ""})
-			} else if rune1 == '&' {
-				tokens = append(tokens, tokenInfo{TerminalBIT_AND, ""})
-			} else if rune1 == '~' {
-				tokens = append(tokens, tokenInfo{TerminalNEG, ""})
-			} else if rune1 == '|' {
-				tokens = append(tokens, tokenInfo{TerminalBIT_OR, ""})
-			} else if rune1 == '^' {
-				tokens = append(tokens, tokenInfo{TerminalBIT_XOR, ""})
-			} else if rune1 == '<' {
-				tokens = append(tokens, tokenInfo{TerminalLT, ""})
-			} else if rune1 == '>' {
-				tokens = append(tokens, tokenInfo{TerminalGT, ""})
-			} else if rune1 == '+' {
-				tokens = append(tokens, tokenInfo{TerminalPLUS, ""})
-			} else if rune1 == '-' {
-				tokens = append(tokens, tokenInfo{TerminalMINUS, ""})
-			} else if rune1 == '*' {
-				tokens = append(tokens, tokenInfo{TerminalTIMES, ""})
-			} else if rune1 == '/' {
-				tokens = append(tokens, tokenInfo{TerminalDIV, ""})
-			} else if rune1 == '%' {
-				tokens = append(tokens, tokenInfo{TerminalMOD, ""})
-			} else if rune1 == '!' {
-				tokens = append(tokens, tokenInfo{TerminalBANG, ""})
-			} else if unicode.IsSpace(rune1) {
-				// Whitespace is ignored in limbo mode
-			} else if isInitialNameChar(rune1) {
-				mode = inIdentifier
-				tokenValue.WriteRune(rune1)
-			} else if isInitialNumberChar(rune1) {
-				mode = inNumber
-				tokenValue.WriteRune(rune1)
-			} else if eof {
-				tokens = append(tokens, tokenInfo{TerminalEOF, ""})
-				break
-			} else {
-				err := fmt.Sprintf("Error at index: %d", i)
-				tokens = append(tokens, tokenInfo{terminalError, err})
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '\'' || r == '"':
+			value, end, err := lexString(buf, i)
+			if err != nil {
+				return nil, err
 			}
+			tokens = append(tokens, tokenInfo{TerminalSTRING, value, i})
+			i = end
 
-		} else if mode == inIdentifier {
-			if rune1 == '\\' {
-				tokenValue.WriteRune(rune2)
-				i += len2
-			} else if rune1 == '(' {
-				tokens = append(tokens, tokenInfo{TerminalID, tokenValue.String()})
-				tokens = append(tokens, tokenInfo{TerminalLPAREN, ""})
-				tokenValue.Reset()
-				mode = inLimbo
-			} else if rune1 == ',' {
-				tokens = append(tokens, tokenInfo{TerminalID, tokenValue.String()})
-				tokens = append(tokens, tokenInfo{TerminalCOMMA, ""})
-				tokenValue.Reset()
-				mode = inLimbo
-			} else if isNameChar(rune1) {
-				tokenValue.WriteRune(rune1)
-			} else {
-				tokens = append(tokens, tokenInfo{TerminalID, tokenValue.String()})
-				tokenValue.Reset()
-				mode = inLimbo
-				// Recheck this rune in limbo mode.
-				continue
+		case isDigit(buf[i]) || (buf[i] == '.' && i+1 < len(buf) && isDigit(buf[i+1])):
+			token, value, end, err := lexNumber(buf, i)
+			if err != nil {
+				return nil, err
 			}
+			tokens = append(tokens, tokenInfo{token, value, i})
+			i = end
 
-		} else if mode == inSingleQuotedString {
-			if rune1 == '\\' {
-				tokenValue.WriteRune(rune2)
-				i += len2
-			} else if rune1 == '\'' {
-				tokens = append(tokens, tokenInfo{TerminalSTRING, tokenValue.String()})
-				tokenValue.Reset()
-				mode = inLimbo
-			} else if eof {
-				err := fmt.Sprintf("String missing closing single quote at index %d", i)
-				tokens = append(tokens, tokenInfo{terminalError, err})
-			} else {
-				tokenValue.WriteRune(rune1)
+		case r == '\\' || isInitialNameChar(r):
+			value, end, err := lexName(buf, i)
+			if err != nil {
+				return nil, err
 			}
+			tokens = append(tokens, tokenInfo{TerminalID, value, i})
+			i = end
 
-		} else if mode == inDoubleQuotedString {
-			if rune1 == '\\' {
-				tokenValue.WriteRune(rune2)
-				i += len2
-			} else if rune1 == '"' {
-				tokens = append(tokens, tokenInfo{TerminalSTRING, tokenValue.String()})
-				tokenValue.Reset()
-				mode = inLimbo
-			} else if eof {
-				err := fmt.Sprintf("String missing closing double quote at index %d", i)
-				tokens = append(tokens, tokenInfo{terminalError, err})
-			} else {
-				tokenValue.WriteRune(rune1)
+		default:
+			token, length := lexPunctuation(buf[i:])
+			if length == 0 {
+				return nil, invalidToken(buf[i:i+size], i)
 			}
+			tokens = append(tokens, tokenInfo{token, "", i})
+			i += length
+		}
+	}
+}
 
-		} else if mode == inNumber {
-			if isNumberChar(rune1) {
-				tokenValue.WriteRune(rune1)
-			} else {
-				tokens = append(tokens, tokenInfo{TerminalINT32, tokenValue.String()})
-				tokenValue.Reset()
-				mode = inLimbo
-				// Recheck this rune in limbo mode.
-				continue
+// Report an invalid token starting at offset
+func invalidToken(text string, offset int) error {
+	return &ParseError{ErrorsInvalidToken, []interface{}{text, int32(offset)}}
+}
+
+// Match an operator or punctuation returning its terminal and length,
+// or a zero length if there's none
+func lexPunctuation(s string) (token int, length int) {
+	for _, p := range punctuation {
+		if strings.HasPrefix(s, p.text) {
+			return p.token, len(p.text)
+		}
+	}
+	return 0, 0
+}
+
+// Read a name in which a backslash escapes any following character
+func lexName(buf string, start int) (value string, end int, err error) {
+	var sb strings.Builder
+	i := start
+	for i < len(buf) {
+		r, size := utf8.DecodeRuneInString(buf[i:])
+		if r == '\\' {
+			escaped, esize := utf8.DecodeRuneInString(buf[i+1:])
+			if esize == 0 || (escaped == utf8.RuneError && esize == 1) {
+				return "", 0, invalidToken(buf[i:i+1+esize], i)
 			}
+			sb.WriteRune(escaped)
+			i += 1 + esize
+			continue
+		}
+		if !isNameChar(r) {
+			break
+		}
+		sb.WriteRune(r)
+		i += size
+	}
+	return sb.String(), i, nil
+}
+
+// Read a single or double quoted string processing escapes
+func lexString(buf string, start int) (value string, end int, err error) {
+	var sb strings.Builder
+	quote := rune(buf[start])
+	for i := start + 1; ; {
+		r, size := utf8.DecodeRuneInString(buf[i:])
+		switch {
+		case size == 0 || (r == '\\' && i+1 == len(buf)):
+			return "", 0, &ParseError{ErrorsUnterminatedString, []interface{}{int32(start)}}
+
+		case r == utf8.RuneError && size == 1:
+			return "", 0, invalidToken(buf[i:i+1], i)
 
-		} else {
-			panic("panic")
+		case r == quote:
+			return sb.String(), i + size, nil
+
+		case r == '\\':
+			escaped, end, err := lexEscape(buf, i)
+			if err != nil {
+				return "", 0, err
+			}
+			sb.WriteRune(escaped)
+			i = end
+
+		default:
+			sb.WriteRune(r)
+			i += size
+		}
+	}
+}
+
+// Decode the escape sequence at buf[i], a backslash followed by at
+// least one character. Newline, tab and carriage return are written
+// \n, \t and \r and any code point as \uXXXX while any other
+// character following a backslash stands for itself.
+func lexEscape(buf string, i int) (r rune, end int, err error) {
+	r, size := utf8.DecodeRuneInString(buf[i+1:])
+	switch r {
+	case 'n':
+		return '\n', i + 2, nil
+	case 't':
+		return '\t', i + 2, nil
+	case 'r':
+		return '\r', i + 2, nil
+	case 'u':
+		if i+6 <= len(buf) {
+			code, err := strconv.ParseUint(buf[i+2:i+6], 16, 32)
+			if err == nil && utf8.ValidRune(rune(code)) {
+				return rune(code), i + 6, nil
+			}
+		}
+		return 0, 0, invalidToken(word(buf, i+1, "\\"), i)
+	case utf8.RuneError:
+		if size == 1 {
+			return 0, 0, invalidToken(buf[i:i+2], i)
 		}
+	}
+	return r, i + 1 + size, nil
+}
 
-		// FIXME: remove debug printing ...
-		if false {
-			fmt.Printf("i=%d, r1=%v, s2=%s, s3=%s, mode=%d, tokenValue=%s, tokens=%#v\n",
-				i, rune1, s2, s3, mode, tokenValue.String(), tokens)
+// Read a numeric literal. These are int32 unless suffixed with L for
+// int64 (either may be decimal, hex with a leading 0x, or octal with
+// a leading 0) or real64 if they have a decimal point or exponent.
+// The value is the literal without any suffix.
+func lexNumber(buf string, start int) (token int, value string, end int, err error) {
+	token = TerminalINT32
+	i := start
+	if strings.HasPrefix(buf[i:], "0x") || strings.HasPrefix(buf[i:], "0X") {
+		i = skip(buf, i+2, isHexDigit)
+		if i == start+2 {
+			return 0, "", 0, invalidToken(word(buf, start, ""), start)
+		}
+	} else {
+		i = skip(buf, i, isDigit)
+		if i < len(buf) && buf[i] == '.' {
+			token = TerminalREAL64
+			i = skip(buf, i+1, isDigit)
 		}
-		i += len1
+		if i < len(buf) && (buf[i] == 'e' || buf[i] == 'E') {
+			// An exponent needs digits, otherwise the e is
+			// left to be reported below
+			j := i + 1
+			if j < len(buf) && (buf[j] == '+' || buf[j] == '-') {
+				j++
+			}
+			if k := skip(buf, j, isDigit); k > j {
+				token = TerminalREAL64
+				i = k
+			}
+		}
+		if token == TerminalINT32 && buf[start] == '0' && skip(buf, start, isOctalDigit) != i {
+			return 0, "", 0, invalidToken(word(buf, start, ""), start)
+		}
+	}
+
+	value = buf[start:i]
+	if token == TerminalINT32 && i < len(buf) && (buf[i] == 'L' || buf[i] == 'l') {
+		token = TerminalINT64
+		i++
 	}
 
-	return tokens
+	// A number can't run straight into a name or another number
+	if r, _ := utf8.DecodeRuneInString(buf[i:]); r == '.' || r == '\\' || isInitialNameChar(r) || unicode.IsDigit(r) {
+		return 0, "", 0, invalidToken(word(buf, start, ""), start)
+	}
+	return token, value, i, nil
+}
+
+// The index of the first byte from i that isn't accepted
+func skip(buf string, i int, accept func(byte) bool) int {
+	for i < len(buf) && accept(buf[i]) {
+		i++
+	}
+	return i
+}
+
+// The run of letters, digits, underscores and points from start, with
+// a prefix, used to show a malformed literal in an error
+func word(buf string, start int, prefix string) string {
+	end := skip(buf, start, func(c byte) bool {
+		return isDigit(c) || c == '_' || c == '.' || (c|0x20 >= 'a' && c|0x20 <= 'z')
+	})
+	return prefix + buf[start:end]
 }
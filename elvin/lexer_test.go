@@ -27,7 +27,7 @@ import (
 func TestRightShiftZero(t *testing.T) {
 	s := " 42 >>> 3 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -40,7 +40,7 @@ func TestRightShiftZero(t *testing.T) {
 func TestRightShift(t *testing.T) {
 	s := " 42 >> 3 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -53,7 +53,7 @@ func TestRightShift(t *testing.T) {
 func TestLeftShift(t *testing.T) {
 	s := " 42 << 3 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -66,7 +66,7 @@ func TestLeftShift(t *testing.T) {
 func TestLogicalAnd(t *testing.T) {
 	s := " a && b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -79,7 +79,7 @@ func TestLogicalAnd(t *testing.T) {
 func TestLogicalOr(t *testing.T) {
 	s := " a || b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -92,7 +92,7 @@ func TestLogicalOr(t *testing.T) {
 func TestLogicalXor(t *testing.T) {
 	s := " a ^^ b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -105,7 +105,7 @@ func TestLogicalXor(t *testing.T) {
 func TestEquals(t *testing.T) {
 	s := " a == b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -118,7 +118,7 @@ func TestEquals(t *testing.T) {
 func TestNotEquals(t *testing.T) {
 	s := " a != b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -131,7 +131,7 @@ func TestNotEquals(t *testing.T) {
 func TestLessThanOrEquals(t *testing.T) {
 	s := " a <= b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -144,7 +144,7 @@ func TestLessThanOrEquals(t *testing.T) {
 func TestGreaterThanOrEquals(t *testing.T) {
 	s := " a >= b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -157,7 +157,7 @@ func TestGreaterThanOrEquals(t *testing.T) {
 func TestIdentifier(t *testing.T) {
 	s := " a == 1 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -172,10 +172,9 @@ func TestIdentifier(t *testing.T) {
 }
 
 func TestIdentifierWithLeadingEscape(t *testing.T) {
-	t.Skip("Until it actually works")
-	s := " \require == 1 "
+	s := " \\require == 1 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -192,7 +191,7 @@ func TestIdentifierWithLeadingEscape(t *testing.T) {
 func TestLeftParenthesis(t *testing.T) {
 	s := " (foo == 1 || bar == 1) && baz == 3 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 14 {
 		t.Error("Expected 14 tokens; lexer reported ", len(tokens))
 	}
@@ -205,7 +204,7 @@ func TestLeftParenthesis(t *testing.T) {
 func TestRightParenthesis(t *testing.T) {
 	s := " (foo == 1 || bar == 1) && baz == 3 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 14 {
 		t.Error("Expected 14 tokens; lexer reported ", len(tokens))
 	}
@@ -218,7 +217,7 @@ func TestRightParenthesis(t *testing.T) {
 func TestComma(t *testing.T) {
 	s := "equals(Group, 'foo', 'bar', 'baz')"
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 11 {
 		t.Error("Expecting 11 tokens; lexer reported ", len(tokens))
 	}
@@ -231,7 +230,7 @@ func TestComma(t *testing.T) {
 func TestBitwiseAnd(t *testing.T) {
 	s := " b & 15 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -244,7 +243,7 @@ func TestBitwiseAnd(t *testing.T) {
 func TestBitwiseOr(t *testing.T) {
 	s := " b | 15 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -257,7 +256,7 @@ func TestBitwiseOr(t *testing.T) {
 func TestBitwiseXor(t *testing.T) {
 	s := " b ^ 15 "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 4 {
 		t.Error("Expected 4 tokens; lexer reported ", len(tokens))
 	}
@@ -270,7 +269,7 @@ func TestBitwiseXor(t *testing.T) {
 func TestBitwiseComplement(t *testing.T) {
 	s := " ~b "
 	var tokens []tokenInfo
-	tokens = Lexer(s)
+	tokens, _ = Lexer(s)
 	if len(tokens) != 3 {
 		t.Error("Expected 3 tokens; lexer reported ", len(tokens))
 	}
@@ -279,3 +278,288 @@ func TestBitwiseComplement(t *testing.T) {
 		t.Error("Expected bitwise-complement; lexer reported ", tokens[0].token)
 	}
 }
+
+func TestTokenOffsets(t *testing.T) {
+	s := "(foo == 'bar') && require(\\baz) >>> 1.5"
+	offsets := []int{0, 1, 5, 8, 13, 15, 18, 25, 26, 30, 32, 36, 39}
+	tokens, err := Lexer(s)
+	if err != nil {
+		t.Fatal("Lexer failed:", err)
+	}
+	if len(tokens) != len(offsets) {
+		t.Fatalf("Expected %d tokens; lexer reported %d", len(offsets), len(tokens))
+	}
+	for i, token := range tokens {
+		if token.offset != offsets[i] {
+			t.Errorf("Token %d (%s) at offset %d, expected %d", i, tokenString(token), token.offset, offsets[i])
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		s      string
+		code   uint16
+		offset int
+	}{
+		{"a == 'foo", ErrorsUnterminatedString, 5},
+		{"a == \"foo\\\"", ErrorsUnterminatedString, 5},
+		{"a == #", ErrorsInvalidToken, 5},
+		{"a == 1 && b == \x80", ErrorsInvalidToken, 15},
+	}
+
+	for _, test := range tests {
+		_, err := Lexer(test.s)
+		parseError, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Lexer(%q) returned %v, expected a *ParseError", test.s, err)
+			continue
+		}
+		if parseError.ErrorCode != test.code || parseError.Offset() != test.offset {
+			t.Errorf("Lexer(%q) returned %v, expected code %d at %d", test.s, err, test.code, test.offset)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		s     string
+		token int
+		value string
+	}{
+		{"42", TerminalINT32, "42"},
+		{"42L", TerminalINT64, "42"},
+		{"42l", TerminalINT64, "42"},
+		{"0", TerminalINT32, "0"},
+		{"052", TerminalINT32, "052"},
+		{"0x2A", TerminalINT32, "0x2A"},
+		{"0X2aL", TerminalINT64, "0X2a"},
+		{"1.5", TerminalREAL64, "1.5"},
+		{"1.", TerminalREAL64, "1."},
+		{".5", TerminalREAL64, ".5"},
+		{"1e3", TerminalREAL64, "1e3"},
+		{"1E+3", TerminalREAL64, "1E+3"},
+		{"2.5e-3", TerminalREAL64, "2.5e-3"},
+	}
+
+	for _, test := range tests {
+		tokens, err := Lexer(test.s)
+		if err != nil {
+			t.Errorf("Lexer(%s) failed: %v", test.s, err)
+			continue
+		}
+		if len(tokens) != 2 || tokens[0].token != test.token || tokens[0].value != test.value {
+			t.Errorf("Lexer(%s) returned %v", test.s, tokens)
+		}
+	}
+
+	// Numbers and operators need no space between them
+	tokens, _ := Lexer("1-2")
+	if len(tokens) != 4 || tokens[1].token != TerminalMINUS {
+		t.Errorf("Lexer(1-2) returned %v", tokens)
+	}
+}
+
+func TestNumberValues(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		s     string
+		value interface{}
+	}{
+		{"42", int32(42)},
+		{"052", int32(42)},
+		{"0x2A", int32(42)},
+		{"2147483647", int32(2147483647)},
+		{"0x7fffffff", int32(2147483647)},
+		{"0xffffffff", int32(-1)},
+		{"037777777777", int32(-1)},
+		{"42L", int64(42)},
+		{"9223372036854775807L", int64(9223372036854775807)},
+		{"0xffffffffffffffffL", int64(-1)},
+		{"1e3", 1000.0},
+		{".5", 0.5},
+		{"1.", 1.0},
+		{"2.5e-3", 0.0025},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse("a == " + test.s)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.s, err)
+			continue
+		}
+		if value := ast.Children[1].Value; value != test.value {
+			t.Errorf("Parse(%s): expected %T %v got %T %v", test.s, test.value, test.value, value, value)
+		}
+	}
+}
+
+func TestBadNumbers(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		s    string
+		code uint16
+	}{
+		{"2147483648", ErrorsOverflow},
+		{"0x100000000", ErrorsOverflow},
+		{"9223372036854775808L", ErrorsOverflow},
+		{"0x10000000000000000L", ErrorsOverflow},
+		{"1e400", ErrorsOverflow},
+		{"1e", ErrorsInvalidToken},
+		{"1e+", ErrorsInvalidToken},
+		{"0x", ErrorsInvalidToken},
+		{"0xg", ErrorsInvalidToken},
+		{"08", ErrorsInvalidToken},
+		{"1.2.3", ErrorsInvalidToken},
+		{"12abc", ErrorsInvalidToken},
+		{"1L2", ErrorsInvalidToken},
+		{"1.5L", ErrorsInvalidToken},
+	}
+
+	for _, test := range tests {
+		_, err := parser.Parse("a == " + test.s)
+		parseError, ok := err.(*ParseError)
+		if !ok || parseError.ErrorCode != test.code || parseError.Offset() != 5 {
+			t.Errorf("Parse(%s) returned %v, expected code %d at 5", test.s, err, test.code)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		s     string
+		value string
+	}{
+		{`'abc'`, "abc"},
+		{`"abc"`, "abc"},
+		{`''`, ""},
+		{`'it\'s'`, "it's"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`'say "hi"'`, `say "hi"`},
+		{`'back\\slash'`, `back\slash`},
+		{`'a\nb\tc\rd'`, "a\nb\tc\rd"},
+		{`'\q'`, "q"},
+		{`'été'`, "été"},
+		{`"été"`, "été"},
+	}
+
+	for _, test := range tests {
+		tokens, err := Lexer(test.s)
+		if err != nil {
+			t.Errorf("Lexer(%s) failed: %v", test.s, err)
+			continue
+		}
+		if len(tokens) != 2 || tokens[0].token != TerminalSTRING || tokens[0].value != test.value {
+			t.Errorf("Lexer(%s) returned %v", test.s, tokens)
+		}
+	}
+
+	for _, s := range []string{`'\u12'`, `'\u00zz'`, `'\ud800'`} {
+		_, err := Lexer(s)
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != ErrorsInvalidToken || parseError.Offset() != 1 {
+			t.Errorf("Lexer(%s) returned %v, expected an invalid token at 1", s, err)
+		}
+	}
+	for _, s := range []string{`'abc`, `"abc\"`, `'abc\`} {
+		_, err := Lexer(s)
+		if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != ErrorsUnterminatedString || parseError.Offset() != 0 {
+			t.Errorf("Lexer(%s) returned %v, expected an unterminated string at 0", s, err)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		s     string
+		value string
+	}{
+		{"a", "a"},
+		{"_a1", "_a1"},
+		{"begins-with", "begins-with"},
+		{"a.b:c/d", "a.b:c/d"},
+		{"ünïcode", "ünïcode"},
+		{"名前", "名前"},
+		{"\\1st", "1st"},
+		{"a\\ b", "a b"},
+		{"\\(\\)\\,\\'\\\"\\\\", "(),'\"\\"},
+	}
+
+	for _, test := range tests {
+		tokens, err := Lexer(test.s)
+		if err != nil {
+			t.Errorf("Lexer(%s) failed: %v", test.s, err)
+			continue
+		}
+		if len(tokens) != 2 || tokens[0].token != TerminalID || tokens[0].value != test.value {
+			t.Errorf("Lexer(%s) returned %v", test.s, tokens)
+		}
+	}
+
+	// Symbols outside ASCII must be escaped
+	_, err := Lexer("price€ == 1")
+	if parseError, ok := err.(*ParseError); !ok || parseError.ErrorCode != ErrorsInvalidToken || parseError.Offset() != 5 {
+		t.Errorf("Lexer returned %v, expected an invalid token at 5", err)
+	}
+	tokens, err := Lexer("price\\€ == 1")
+	if err != nil || tokens[0].value != "price€" {
+		t.Errorf("Lexer returned %v %v", tokens, err)
+	}
+}
+
+// Inputs exercising the lexer's corners, also the fuzzing corpus
+var lexerSeeds = []string{
+	" 42 >>> 3 ", " a && b ", " a ^^ b ", " a != b ", " \\require == 1 ",
+	" (foo == 1 || bar == 1) && baz == 3 ", " a & b | c ^ d ", " ~b ",
+	"a == 0x2AL || b < 1.5e-3 && c != 052", "1-2 == -x", ".5 * 2. >= 1E+3",
+	"a == 'it\\'s' || b == \"\\u00e9\\n\"", "\\1st\\ name == 1", "ünïcode == '名前'",
+	"begins-with(fold-case(a), 'x', \"y\")", "a == 'unterminated", "1e", "08", "0x",
+	"price€ == 1", "a == \x80", "a == '\\u12'", "2147483648", "a\\",
+}
+
+func TestLexerInvariants(t *testing.T) {
+	for _, s := range lexerSeeds {
+		checkLexer(t, s)
+	}
+}
+
+// Check the lexer's invariants on any input, and that anything that
+// parses formats to an expression that parses to the same format
+func checkLexer(t *testing.T, s string) {
+	t.Helper()
+	tokens, err := Lexer(s)
+	if err != nil {
+		parseError, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("Lexer(%q) returned %T", s, err)
+		}
+		if offset := parseError.Offset(); offset < 0 || offset > len(s) {
+			t.Fatalf("Lexer(%q) error offset %d out of range", s, offset)
+		}
+		return
+	}
+
+	last := -1
+	for _, token := range tokens {
+		if token.offset <= last || token.offset > len(s) {
+			t.Fatalf("Lexer(%q) token offsets out of order: %v", s, tokens)
+		}
+		last = token.offset
+	}
+	if tokens[len(tokens)-1].token != TerminalEOF {
+		t.Fatalf("Lexer(%q) didn't end with EOF", s)
+	}
+
+	var parser Parser
+	ast, err := parser.Parse(s)
+	if err != nil {
+		return
+	}
+	formatted := Format(ast)
+	ast2, err := parser.Parse(formatted)
+	if err != nil {
+		t.Fatalf("Parse(%q) of Format(%q) failed: %v", formatted, s, err)
+	}
+	if Format(ast2) != formatted {
+		t.Fatalf("Format(%q) is %q then %q", s, formatted, Format(ast2))
+	}
+}
@@ -441,3 +441,138 @@ func (pkt *ConfConn) Decode(bytes []byte) (err error) {
 func (pkt *ConfConn) Encode(buffer *bytes.Buffer) {
 	XdrPutInt32(buffer, int32(pkt.ID()))
 }
+
+// Packet: Security Request
+type SecRequest struct {
+	XID        uint32
+	AddNfnKeys KeyBlock
+	DelNfnKeys KeyBlock
+	AddSubKeys KeyBlock
+	DelSubKeys KeyBlock
+}
+
+// Integer value of packet type
+func (pkt *SecRequest) ID() int {
+	return PacketSecRequest
+}
+
+// String representation of packet type
+func (pkt *SecRequest) IDString() string {
+	return "SecRequest"
+}
+
+// Pretty print with indent
+func (pkt *SecRequest) IString(indent string) string {
+	return fmt.Sprintf(
+		"%sXID: %d\n"+
+			"%sAddNfnKeys: %v\n"+
+			"%sDelNfnKeys: %v\n"+
+			"%sAddSubKeys: %v\n"+
+			"%sDelSubKeys: %v\n",
+		indent, pkt.XID,
+		indent, pkt.AddNfnKeys,
+		indent, pkt.DelNfnKeys,
+		indent, pkt.AddSubKeys,
+		indent, pkt.DelSubKeys)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SecRequest) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SecRequest packet from a byte array
+func (pkt *SecRequest) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.AddNfnKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DelNfnKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.AddSubKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	pkt.DelSubKeys, used, err = XdrGetKeys(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a SecRequest into a buffer
+func (pkt *SecRequest) Encode(buffer *bytes.Buffer) (xID uint32) {
+	xID = XID()
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, xID)
+	XdrPutKeys(buffer, pkt.AddNfnKeys)
+	XdrPutKeys(buffer, pkt.DelNfnKeys)
+	XdrPutKeys(buffer, pkt.AddSubKeys)
+	XdrPutKeys(buffer, pkt.DelSubKeys)
+
+	return
+}
+
+// Packet: Security Reply
+type SecReply struct {
+	XID uint32
+}
+
+// Integer value of packet type
+func (pkt *SecReply) ID() int {
+	return PacketSecReply
+}
+
+// String representation of packet type
+func (pkt *SecReply) IDString() string {
+	return "SecReply"
+}
+
+// Pretty print with indent
+func (pkt *SecReply) IString(indent string) string {
+	return fmt.Sprintf("%sXID: %d\n", indent, pkt.XID)
+}
+
+// Pretty print without indent so generic ToString() works
+func (pkt *SecReply) String() string {
+	return pkt.IString("")
+}
+
+// Decode a SecReply packet from a byte array
+func (pkt *SecReply) Decode(bytes []byte) (err error) {
+	var used int
+	offset := 4 // header
+
+	pkt.XID, used, err = XdrGetUint32(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
+
+	return nil
+}
+
+// Encode a SecReply into a buffer
+func (pkt *SecReply) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
+	XdrPutUint32(buffer, pkt.XID)
+}
@@ -25,10 +25,6 @@ import (
 	"fmt"
 )
 
-type SubAST struct {
-	dummy int
-}
-
 // Packet: QuenchAddRequest
 type QuenchAddRequest struct {
 	XID             uint32
@@ -383,7 +379,7 @@ type SubAddNotify struct {
 	SecureQuenchIDs   []int64
 	InsecureQuenchIDs []int64
 	TermID            uint64
-	SubExpr           SubAST
+	SubExpr           *AST
 }
 
 // Integer value of packet type
@@ -426,11 +422,13 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 	offset += used
 
 	for i := uint32(0); i < secureQidsCount; i++ {
-		pkt.SecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
+		var quenchID int64
+		quenchID, used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
 			return err
 		}
 		offset += used
+		pkt.SecureQuenchIDs = append(pkt.SecureQuenchIDs, quenchID)
 	}
 
 	insecureQidsCount, used, err := XdrGetUint32(bytes[offset:])
@@ -440,11 +438,13 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 	offset += used
 
 	for i := uint32(0); i < insecureQidsCount; i++ {
-		pkt.InsecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
+		var quenchID int64
+		quenchID, used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
 			return err
 		}
 		offset += used
+		pkt.InsecureQuenchIDs = append(pkt.InsecureQuenchIDs, quenchID)
 	}
 
 	pkt.TermID, used, err = XdrGetUint64(bytes[offset:])
@@ -453,14 +453,18 @@ func (pkt *SubAddNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
-	// FIXME
-	// pkt.SubExpr
+	pkt.SubExpr, used, err = XdrGetSubAST(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
 
 	return nil
 }
 
 // Encode from a buffer
 func (pkt *SubAddNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.SecureQuenchIDs)))
 	for i := 0; i < len(pkt.SecureQuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.SecureQuenchIDs[i])
@@ -473,8 +477,7 @@ func (pkt *SubAddNotify) Encode(buffer *bytes.Buffer) {
 
 	XdrPutUint64(buffer, pkt.TermID)
 
-	// FIXME
-	// SubExpr
+	XdrPutSubAST(buffer, pkt.SubExpr)
 }
 
 // Packet: SubModNotify
@@ -482,7 +485,7 @@ type SubModNotify struct {
 	SecureQuenchIDs   []int64
 	InsecureQuenchIDs []int64
 	TermID            uint64
-	SubExpr           SubAST
+	SubExpr           *AST
 }
 
 // Integer value of packet type
@@ -525,11 +528,13 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 	offset += used
 
 	for i := uint32(0); i < secureQidsCount; i++ {
-		pkt.SecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
+		var quenchID int64
+		quenchID, used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
 			return err
 		}
 		offset += used
+		pkt.SecureQuenchIDs = append(pkt.SecureQuenchIDs, quenchID)
 	}
 
 	insecureQidsCount, used, err := XdrGetUint32(bytes[offset:])
@@ -539,11 +544,13 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 	offset += used
 
 	for i := uint32(0); i < insecureQidsCount; i++ {
-		pkt.InsecureQuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
+		var quenchID int64
+		quenchID, used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
 			return err
 		}
 		offset += used
+		pkt.InsecureQuenchIDs = append(pkt.InsecureQuenchIDs, quenchID)
 	}
 
 	pkt.TermID, used, err = XdrGetUint64(bytes[offset:])
@@ -552,14 +559,18 @@ func (pkt *SubModNotify) Decode(bytes []byte) (err error) {
 	}
 	offset += used
 
-	// FIXME
-	// pkt.SubExpr
+	pkt.SubExpr, used, err = XdrGetSubAST(bytes[offset:])
+	if err != nil {
+		return err
+	}
+	offset += used
 
 	return nil
 }
 
 // Encode from a buffer
 func (pkt *SubModNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.SecureQuenchIDs)))
 	for i := 0; i < len(pkt.SecureQuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.SecureQuenchIDs[i])
@@ -572,8 +583,7 @@ func (pkt *SubModNotify) Encode(buffer *bytes.Buffer) {
 
 	XdrPutUint64(buffer, pkt.TermID)
 
-	// FIXME
-	// SubExpr
+	XdrPutSubAST(buffer, pkt.SubExpr)
 }
 
 // Packet: SubDelNotify
@@ -618,11 +628,13 @@ func (pkt *SubDelNotify) Decode(bytes []byte) (err error) {
 	offset += used
 
 	for i := uint32(0); i < qidCount; i++ {
-		pkt.QuenchIDs[i], used, err = XdrGetInt64(bytes[offset:])
+		var quenchID int64
+		quenchID, used, err = XdrGetInt64(bytes[offset:])
 		if err != nil {
 			return err
 		}
 		offset += used
+		pkt.QuenchIDs = append(pkt.QuenchIDs, quenchID)
 	}
 
 	pkt.TermID, used, err = XdrGetUint64(bytes[offset:])
@@ -636,6 +648,7 @@ func (pkt *SubDelNotify) Decode(bytes []byte) (err error) {
 
 // Encode from a buffer
 func (pkt *SubDelNotify) Encode(buffer *bytes.Buffer) {
+	XdrPutInt32(buffer, int32(pkt.ID()))
 	XdrPutUint32(buffer, uint32(len(pkt.QuenchIDs)))
 	for i := 0; i < len(pkt.QuenchIDs); i++ {
 		XdrPutInt64(buffer, pkt.QuenchIDs[i])
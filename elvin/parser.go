@@ -20,5 +20,331 @@
 
 package elvin
 
+import (
+	"fmt"
+	"strconv"
+)
+
+// A Parser turns subscription expressions into an AST by driving the
+// tpc generated tables in elvin4.go over the tokens from Lexer().
+// The zero value is ready to use and a Parser may be shared.
 type Parser struct {
 }
+
+// A ParseError describes why an expression was rejected using the
+// error code and arguments a router would send in a Nack
+type ParseError struct {
+	ErrorCode uint16
+	Args      []interface{}
+}
+
+// Format the error using the standard Elvin message for its code
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.ErrorCode,
+		fmt.Sprintf(ElvinStringToFormatString(ProtocolErrors[e.ErrorCode].Message), e.Args...))
+}
+
+// The byte offset within the expression at which the error was found.
+// By convention this is the last of the Args.
+func (e *ParseError) Offset() int {
+	if len(e.Args) > 0 {
+		if offset, ok := e.Args[len(e.Args)-1].(int32); ok {
+			return int(offset)
+		}
+	}
+	return 0
+}
+
+// Create a Nack (without an XID) describing the error
+func (e *ParseError) Nack() *Nack {
+	nack := new(Nack)
+	nack.ErrorCode = e.ErrorCode
+	nack.Message = ProtocolErrors[e.ErrorCode].Message
+	nack.Args = e.Args
+	return nack
+}
+
+// Set the offset, the last of the Args, returning the error
+func (e *ParseError) at(offset int) *ParseError {
+	if len(e.Args) > 0 {
+		if _, ok := e.Args[len(e.Args)-1].(int32); ok {
+			e.Args[len(e.Args)-1] = int32(offset)
+		}
+	}
+	return e
+}
+
+// Parse a subscription expression returning it's AST or a *ParseError
+func (parser *Parser) Parse(expr string) (ast *AST, err error) {
+	tokens, err := Lexer(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The LR stack holds parser states, and alongside it the
+	// semantic value of each shifted terminal or reduced
+	// non-terminal: a *AST, an []*AST of function arguments or
+	// an identifier's string. The offset of each value's first
+	// token is kept so errors found on reduction can be located.
+	states := []int{0}
+	values := []interface{}{nil}
+	offsets := []int{0}
+
+	for i := 0; i < len(tokens); {
+		token := tokens[i]
+		state := states[len(states)-1]
+		action := strTable[state][token.token]
+
+		switch {
+		case action == ERR:
+			return nil, &ParseError{ErrorsParsing, []interface{}{tokenString(token), int32(token.offset)}}
+
+		case action == ACC:
+			// Production 0 is <sub-exp> ::= <disjunction> so
+			// accepting is the same as that reduction
+			return values[len(values)-1].(*AST), nil
+
+		case action >= S(0):
+			value, err := shiftValue(token)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, action-S(0))
+			values = append(values, value)
+			offsets = append(offsets, token.offset)
+			i++
+
+		default:
+			production := Productions[action]
+			base := len(values) - production.count
+			offset := offsets[base]
+			value, err := reduce(production.reduction, values[base:], offset)
+			if err != nil {
+				return nil, err
+			}
+			states = states[:base]
+			values = values[:base]
+			offsets = offsets[:base]
+			next := GotoTable[states[len(states)-1]][production.nonTerminalType]
+			states = append(states, next)
+			values = append(values, value)
+			offsets = append(offsets, offset)
+		}
+	}
+
+	// The lexer always ends with an EOF so we only get here if
+	// it was given nothing at all
+	return nil, &ParseError{ErrorsParsing, []interface{}{"", int32(len(expr))}}
+}
+
+// A printable version of a token for error reporting
+func tokenString(token tokenInfo) string {
+	if token.token == TerminalEOF {
+		return "end of expression"
+	}
+	if len(token.value) > 0 {
+		return token.value
+	}
+	return terminalNames[token.token]
+}
+
+// Operator spellings, indexed by terminal
+var terminalNames = []string{
+	TerminalEOF:     "",
+	TerminalLPAREN:  "(",
+	TerminalRPAREN:  ")",
+	TerminalID:      "",
+	TerminalCOMMA:   ",",
+	TerminalOR:      "||",
+	TerminalXOR:     "^^",
+	TerminalAND:     "&&",
+	TerminalEQ:      "==",
+	TerminalNEQ:     "!=",
+	TerminalLT:      "<",
+	TerminalLE:      "<=",
+	TerminalGT:      ">",
+	TerminalGE:      ">=",
+	TerminalBANG:    "!",
+	TerminalSTRING:  "",
+	TerminalBIT_OR:  "|",
+	TerminalBIT_XOR: "^",
+	TerminalBIT_AND: "&",
+	TerminalBIT_SHL: "<<",
+	TerminalBIT_SHR: ">>",
+	TerminalBIT_LSR: ">>>",
+	TerminalPLUS:    "+",
+	TerminalMINUS:   "-",
+	TerminalTIMES:   "*",
+	TerminalDIV:     "/",
+	TerminalMOD:     "%",
+	TerminalINT32:   "",
+	TerminalINT64:   "",
+	TerminalREAL64:  "",
+	TerminalNEG:     "~",
+}
+
+// The semantic value of a shifted terminal
+func shiftValue(token tokenInfo) (value interface{}, err error) {
+	switch token.token {
+	case TerminalID:
+		return token.value, nil
+
+	case TerminalSTRING:
+		return &AST{TypeCode: StringTypeCode, Value: token.value, BaseType: StringTypeCode, offset: token.offset}, nil
+
+	case TerminalINT32:
+		i, err := parseInteger(token.value, 32)
+		if err != nil {
+			return nil, numberError(token, err)
+		}
+		return &AST{TypeCode: Int32TypeCode, Value: int32(i), BaseType: Int32TypeCode, offset: token.offset}, nil
+
+	case TerminalINT64:
+		i, err := parseInteger(token.value, 64)
+		if err != nil {
+			return nil, numberError(token, err)
+		}
+		return &AST{TypeCode: Int64TypeCode, Value: i, BaseType: Int64TypeCode, offset: token.offset}, nil
+
+	case TerminalREAL64:
+		f, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, numberError(token, err)
+		}
+		return &AST{TypeCode: Real64TypeCode, Value: f, BaseType: Real64TypeCode, offset: token.offset}, nil
+	}
+
+	// Punctuation and operators carry no value
+	return nil, nil
+}
+
+// Convert an integer literal in decimal, hex (0x) or octal (leading
+// 0). Hex and octal give a bit pattern so 0xffffffff is -1, allowing
+// masks to be written naturally.
+func parseInteger(s string, bits int) (int64, error) {
+	if len(s) > 1 && s[0] == '0' {
+		u, err := strconv.ParseUint(s, 0, bits)
+		if bits == 32 {
+			return int64(int32(u)), err
+		}
+		return int64(u), err
+	}
+	return strconv.ParseInt(s, 10, bits)
+}
+
+// Map a numeric conversion failure to the appropriate error
+func numberError(token tokenInfo, err error) error {
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+		return &ParseError{ErrorsOverflow, []interface{}{int32(token.offset)}}
+	}
+	return &ParseError{ErrorsInvalidToken, []interface{}{token.value, int32(token.offset)}}
+}
+
+// Type codes for the binary operator reductions
+var binaryReductions = map[string]int{
+	"create_eq_comparison":  EqualsTypeCode,
+	"create_neq_comparison": NotEqualsTypeCode,
+	"create_lt_comparison":  LessThanTypeCode,
+	"create_le_comparison":  LessThanOrEqualsTypeCode,
+	"create_gt_comparison":  GreaterThanTypeCode,
+	"create_ge_comparison":  GreaterThanOrEqualsTypeCode,
+	"create_or_op":          BinaryOrTypeCode,
+	"create_xor_op":         BinaryExclusiveOrTypeCode,
+	"create_and_op":         BinaryAndTypeCode,
+	"create_shl_op":         ShiftLeftTypeCode,
+	"create_shr_op":         ShiftRightTypeCode,
+	"create_lsr_op":         LogicalShiftRightTypeCode,
+	"create_plus_op":        AddTypeCode,
+	"create_minus_op":       SubtractTypeCode,
+	"create_times_op":       MultiplyTypeCode,
+	"create_div_op":         DivideTypeCode,
+	"create_mod_op":         ModuloTypeCode,
+}
+
+// Type codes for the unary operator reductions
+var unaryReductions = map[string]int{
+	"create_not_op":    LogicalNotTypeCode,
+	"create_uplus_op":  UnaryPlusTypeCode,
+	"create_uminus_op": UnaryMinusTypeCode,
+	"create_neg_op":    BinaryNotTypeCode,
+}
+
+// Type codes for the (flattened) logical list reductions
+var logicalReductions = map[string]int{
+	"extend_disjunction": LogicalOrTypeCode,
+	"extend_xor_exp":     LogicalExclusiveOrTypeCode,
+	"extend_conjunction": LogicalAndTypeCode,
+}
+
+// Run a reduction over the values of a production's right hand side,
+// the first of which starts at offset
+func reduce(reduction string, rhs []interface{}, offset int) (value interface{}, err error) {
+	if typeCode, ok := binaryReductions[reduction]; ok {
+		return &AST{TypeCode: typeCode, Children: []*AST{rhs[0].(*AST), rhs[2].(*AST)}, offset: offset}, nil
+	}
+
+	if typeCode, ok := unaryReductions[reduction]; ok {
+		return &AST{TypeCode: typeCode, Children: []*AST{rhs[1].(*AST)}, offset: offset}, nil
+	}
+
+	if typeCode, ok := logicalReductions[reduction]; ok {
+		// Lists of the same logical operator become a single
+		// node as the grammar is left recursive
+		left := rhs[0].(*AST)
+		if left.TypeCode == typeCode {
+			left.Children = append(left.Children, rhs[2].(*AST))
+			return left, nil
+		}
+		return &AST{TypeCode: typeCode, Children: []*AST{left, rhs[2].(*AST)}, offset: offset}, nil
+	}
+
+	switch reduction {
+	case "accept_sub", "identity", "create_disjunction", "create_xor_exp", "create_conjunction":
+		return rhs[0], nil
+
+	case "identity2":
+		return rhs[1], nil
+
+	case "name_from_id":
+		return &AST{TypeCode: NameTypeCode, Value: rhs[0].(string), offset: offset}, nil
+
+	case "create_args":
+		return []*AST{rhs[0].(*AST)}, nil
+
+	case "extend_args":
+		return append(rhs[0].([]*AST), rhs[2].(*AST)), nil
+
+	case "create_function_0":
+		return createFunction(rhs[0].(string), nil, offset)
+
+	case "create_function_n":
+		return createFunction(rhs[0].(string), rhs[2].([]*AST), offset)
+	}
+
+	panic(fmt.Sprintf("Unknown reduction %s", reduction))
+}
+
+// Create a function node, checking it's built-in or registered and
+// has suitable arguments. Errors are reported at the function name's offset.
+func createFunction(name string, args []*AST, offset int) (ast *AST, err error) {
+	f, ok := LookupFunction(name)
+	if !ok {
+		return nil, &ParseError{ErrorsUnknownFunction, []interface{}{int32(offset)}}
+	}
+	min, max := f.arity()
+	if len(args) < min {
+		return nil, &ParseError{ErrorsTooFewArgs, []interface{}{name, int32(offset)}}
+	}
+	if max >= 0 && len(args) > max {
+		return nil, &ParseError{ErrorsParsing, []interface{}{name, int32(offset)}}
+	}
+
+	ast = &AST{TypeCode: f.typeCode, Value: name, Children: args, offset: offset, function: f}
+	if err = checkFunction(ast); err != nil {
+		if parseError, ok := err.(*ParseError); ok {
+			return nil, parseError.at(offset)
+		}
+		return nil, err
+	}
+	return ast, nil
+}
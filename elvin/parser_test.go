@@ -0,0 +1,197 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"testing"
+)
+
+func TestParseComparison(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("a == 1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if ast.TypeCode != EqualsTypeCode {
+		t.Fatalf("Expected EqualsTypeCode; parser returned %d", ast.TypeCode)
+	}
+	if len(ast.Children) != 2 {
+		t.Fatalf("Expected 2 children; parser returned %d", len(ast.Children))
+	}
+	if ast.Children[0].TypeCode != NameTypeCode || ast.Children[0].Value != "a" {
+		t.Errorf("Expected name 'a'; parser returned %+v", ast.Children[0])
+	}
+	if ast.Children[1].TypeCode != Int32TypeCode || ast.Children[1].Value != int32(1) {
+		t.Errorf("Expected int32 1; parser returned %+v", ast.Children[1])
+	}
+}
+
+func TestParseConstants(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr     string
+		typeCode int
+		value    interface{}
+	}{
+		{"a == 42", Int32TypeCode, int32(42)},
+		{"a == 42L", Int64TypeCode, int64(42)},
+		{"a == 4.5", Real64TypeCode, 4.5},
+		{"a == 'foo'", StringTypeCode, "foo"},
+		{"a == \"bar\"", StringTypeCode, "bar"},
+	}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", test.expr, err)
+			continue
+		}
+		value := ast.Children[1]
+		if value.TypeCode != test.typeCode || value.Value != test.value {
+			t.Errorf("Parse(%s): expected %v, got %+v", test.expr, test.value, value)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("a == 1 || b == 2 && c == 3")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.TypeCode != LogicalOrTypeCode {
+		t.Fatalf("Expected LogicalOrTypeCode at root; parser returned %d", ast.TypeCode)
+	}
+	if ast.Children[1].TypeCode != LogicalAndTypeCode {
+		t.Fatalf("Expected LogicalAndTypeCode on right; parser returned %d", ast.Children[1].TypeCode)
+	}
+
+	ast, err = parser.Parse("a + 2 * 3 == 7")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	sum := ast.Children[0]
+	if sum.TypeCode != AddTypeCode || sum.Children[1].TypeCode != MultiplyTypeCode {
+		t.Fatalf("Expected a + (2 * 3); parser returned %+v", sum)
+	}
+
+	ast, err = parser.Parse("(a == 1 || b == 2) && c == 3")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.TypeCode != LogicalAndTypeCode || ast.Children[0].TypeCode != LogicalOrTypeCode {
+		t.Fatalf("Expected (a || b) && c; parser returned %+v", ast)
+	}
+}
+
+func TestParseLogicalLists(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("a == 1 || b == 2 || c == 3 || d == 4")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.TypeCode != LogicalOrTypeCode || len(ast.Children) != 4 {
+		t.Fatalf("Expected a single || with 4 children; parser returned %+v", ast)
+	}
+}
+
+func TestParseUnary(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("!(a == -1)")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.TypeCode != LogicalNotTypeCode {
+		t.Fatalf("Expected LogicalNotTypeCode; parser returned %d", ast.TypeCode)
+	}
+	if minus := ast.Children[0].Children[1]; minus.TypeCode != UnaryMinusTypeCode {
+		t.Fatalf("Expected UnaryMinusTypeCode; parser returned %d", minus.TypeCode)
+	}
+
+	ast, err = parser.Parse("~a == 1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.Children[0].TypeCode != BinaryNotTypeCode {
+		t.Fatalf("Expected BinaryNotTypeCode; parser returned %d", ast.Children[0].TypeCode)
+	}
+}
+
+func TestParseFunction(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("require(TestPass)")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ast.TypeCode != FuncRequireTypeCode {
+		t.Fatalf("Expected FuncRequireTypeCode; parser returned %d", ast.TypeCode)
+	}
+	if len(ast.Children) != 1 || ast.Children[0].Value != "TestPass" {
+		t.Fatalf("Expected argument TestPass; parser returned %+v", ast.Children)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr   string
+		code   uint16
+		offset int
+	}{
+		{"", ErrorsParsing, 0},
+		{"bogus", ErrorsParsing, 5},
+		{"a ==", ErrorsParsing, 4},
+		{"(a == 1", ErrorsParsing, 7},
+		{"a == 1)", ErrorsParsing, 6},
+		{"a == 1 && && b", ErrorsParsing, 10},
+		{"a == 'foo", ErrorsUnterminatedString, 5},
+		{"a == 1 || b == \"foo", ErrorsUnterminatedString, 15},
+		{"a == 1 || b == #", ErrorsInvalidToken, 15},
+		{"a == 99999999999", ErrorsOverflow, 5},
+		{"a == 1 || b == 99999999999999999999L", ErrorsOverflow, 15},
+		{"nosuchfunction(a)", ErrorsUnknownFunction, 0},
+		{"a == 1 && nosuchfunction(a)", ErrorsUnknownFunction, 10},
+		{"require()", ErrorsTooFewArgs, 0},
+		{"a == 1 || require()", ErrorsTooFewArgs, 10},
+		{"a == 1 || regex(b, 'a(')", ErrorsInvalidRegexp, 10},
+		{"a == 1 || size(2)", ErrorsTypeMismatch, 10},
+	}
+
+	for _, test := range tests {
+		_, err := parser.Parse(test.expr)
+		if err == nil {
+			t.Errorf("Parse(%s) succeeded", test.expr)
+			continue
+		}
+		parseError, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Parse(%s) returned %T, not *ParseError", test.expr, err)
+			continue
+		}
+		if parseError.ErrorCode != test.code {
+			t.Errorf("Parse(%s) returned %v, expected code %d", test.expr, err, test.code)
+		}
+		if parseError.Offset() != test.offset {
+			t.Errorf("Parse(%s) returned %v, expected offset %d", test.expr, err, test.offset)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"sync"
+)
+
+// A Producer is a quench-aware ("smart") producer. It quenches on the
+// attribute names it produces and tracks the live set of subscription
+// terms that reference them, so notifications that no subscription
+// could match are never sent. Typically used via:
+//
+//	producer, err := NewProducer(client, names, true, nil)
+//	  producer.Notify()
+//	producer.Close()
+//
+// Elvin only reports terms referencing a quenched name so the names
+// should include every attribute the producer emits.
+type Producer struct {
+	client *Client
+	quench *Quench
+	mu     sync.Mutex
+	terms  map[uint64]*AST // Live subscription terms by TermID
+	done   chan bool
+}
+
+// Create a producer, quenching on names via a connected client
+func NewProducer(client *Client, names map[string]bool, deliverInsecure bool, keys KeyBlock) (producer *Producer, err error) {
+	producer = new(Producer)
+	producer.client = client
+	producer.terms = make(map[uint64]*AST)
+	producer.done = make(chan bool)
+
+	producer.quench = new(Quench)
+	producer.quench.Names = names
+	producer.quench.DeliverInsecure = deliverInsecure
+	producer.quench.Keys = keys
+	producer.quench.Notifications = make(chan QuenchNotification)
+
+	// Terms may arrive as soon as the quench is in place
+	go producer.track()
+
+	if err = client.Quench(producer.quench); err != nil {
+		close(producer.done)
+		return nil, err
+	}
+	return producer, nil
+}
+
+// Keep the set of terms up to date (run as goroutine)
+func (producer *Producer) track() {
+	for {
+		select {
+		case n := <-producer.quench.Notifications:
+			producer.mu.Lock()
+			if n.SubExpr == nil {
+				delete(producer.terms, n.TermID)
+			} else {
+				producer.terms[n.TermID] = n.SubExpr
+			}
+			producer.mu.Unlock()
+		case <-producer.done:
+			return
+		}
+	}
+}
+
+// Could any current subscription match a notification
+func (producer *Producer) Interested(nv map[string]interface{}) bool {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+
+	for _, term := range producer.terms {
+		if term.Match(nv) {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of subscription terms currently referencing our names
+func (producer *Producer) Terms() int {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	return len(producer.terms)
+}
+
+// Send a notification if anyone could be interested in it, returning
+// whether it was sent
+func (producer *Producer) Notify(nv map[string]interface{}, deliverInsecure bool, keys KeyBlock) (sent bool, err error) {
+	if !producer.Interested(nv) {
+		return false, nil
+	}
+	if err = producer.client.Notify(nv, deliverInsecure, keys); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Remove the quench and stop tracking terms
+func (producer *Producer) Close() (err error) {
+	err = producer.client.QuenchDelete(producer.quench)
+	close(producer.done)
+	return err
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Argument types a function may declare. The parser checks each
+// argument against its declared type before the function's Check.
+const (
+	ArgAny            = iota // Any expression
+	ArgName                  // An attribute name
+	ArgString                // An expression that may evaluate to a string
+	ArgStringConstant        // A string literal
+	ArgConstant              // An expression of only constants
+)
+
+// A function that may be called in subscription expressions. Every
+// function, built-in or custom, supplies exactly one of Predicate, for
+// functions returning a truth value, or Value. Either is only called
+// when every argument has a value, being bottom otherwise, and is
+// passed the values of the arguments (so an ArgName argument is the
+// attribute's value, and the built-in wildcard() and regex() get their
+// patterns compiled). Custom functions are called for every
+// notification evaluated, even with constant arguments, and must be
+// safe to call concurrently.
+type Function struct {
+	Name     string
+	Args     []int // The declared type of each argument
+	Variadic bool  // The last argument may be repeated
+	BaseType int   // For value functions the type of the result, if known
+
+	// Check a new function node's arguments once they've been
+	// checked against Args, returning a *ParseError to reject it
+	Check func(node *AST) error
+
+	Predicate func(args []interface{}) int
+	Value     func(args []interface{}) interface{}
+
+	typeCode int
+}
+
+// The minimum and maximum (-1 for unbounded) number of arguments
+func (f *Function) arity() (min int, max int) {
+	if f.Variadic {
+		return len(f.Args), -1
+	}
+	return len(f.Args), len(f.Args)
+}
+
+// The functions known to the parser, built-in and registered
+var functions = struct {
+	sync.RWMutex
+	byName     map[string]*Function
+	byTypeCode map[int]*Function
+}{
+	byName:     make(map[string]*Function),
+	byTypeCode: make(map[int]*Function),
+}
+
+// Register a custom function, making it available to any expression
+// parsed afterwards. Registration usually happens at startup and
+// fails if the name is taken or the function is not well formed.
+func RegisterFunction(f Function) error {
+	if f.Predicate == nil && f.Value == nil || f.Predicate != nil && f.Value != nil {
+		return fmt.Errorf("Function %s must have exactly one of Predicate or Value", f.Name)
+	}
+	f.typeCode = FuncCustomTypeCode
+	return registerFunction(f)
+}
+
+// Remove a custom function, for example when a test is done with it.
+// Subscriptions already using it keep doing so. Built-in functions
+// can't be removed.
+func UnregisterFunction(name string) error {
+	functions.Lock()
+	defer functions.Unlock()
+	f, ok := functions.byName[name]
+	if !ok {
+		return fmt.Errorf("Function %s is not registered", name)
+	}
+	if f.typeCode != FuncCustomTypeCode {
+		return fmt.Errorf("Function %s is built in", name)
+	}
+	delete(functions.byName, name)
+	return nil
+}
+
+// Register a function, built-in or custom
+func registerFunction(f Function) error {
+	if tokens, err := Lexer(f.Name); err != nil || len(tokens) != 2 || tokens[0].token != TerminalID || tokens[0].value != f.Name {
+		return fmt.Errorf("Function name %q is not a valid identifier", f.Name)
+	}
+	if f.Variadic && len(f.Args) == 0 {
+		return fmt.Errorf("Function %s is variadic without arguments", f.Name)
+	}
+	for _, arg := range f.Args {
+		if arg < ArgAny || arg > ArgConstant {
+			return fmt.Errorf("Function %s has unknown argument type %d", f.Name, arg)
+		}
+	}
+
+	functions.Lock()
+	defer functions.Unlock()
+	if _, ok := functions.byName[f.Name]; ok {
+		return fmt.Errorf("Function %s is already registered", f.Name)
+	}
+	functions.byName[f.Name] = &f
+	if f.typeCode != FuncCustomTypeCode {
+		functions.byTypeCode[f.typeCode] = &f
+	}
+	return nil
+}
+
+// Find a function, built-in or registered, by name
+func LookupFunction(name string) (f *Function, ok bool) {
+	functions.RLock()
+	defer functions.RUnlock()
+	f, ok = functions.byName[name]
+	return f, ok
+}
+
+// Find a built-in function by its type code
+func builtinFunction(typeCode int) (f *Function, ok bool) {
+	functions.RLock()
+	defer functions.RUnlock()
+	f, ok = functions.byTypeCode[typeCode]
+	return f, ok
+}
+
+// The name of a function node
+func functionName(node *AST) (name string, ok bool) {
+	if node.function != nil {
+		return node.function.Name, true
+	}
+	if f, ok := builtinFunction(node.TypeCode); ok {
+		return f.Name, true
+	}
+	return "", false
+}
+
+// Check a function node's arguments against their declared types and
+// then the function's own Check, preparing anything needed for
+// evaluation. The number of arguments has already been checked.
+func checkFunction(node *AST) error {
+	f := node.function
+	for i, arg := range node.Children {
+		declared := f.Args[len(f.Args)-1]
+		if i < len(f.Args) {
+			declared = f.Args[i]
+		}
+
+		switch declared {
+		case ArgName:
+			if arg.TypeCode != NameTypeCode {
+				return typeMismatch(arg, "name")
+			}
+		case ArgString:
+			if !isStringValued(arg) {
+				return typeMismatch(arg, "string")
+			}
+		case ArgStringConstant:
+			if arg.TypeCode != StringTypeCode {
+				return typeMismatch(arg, "string")
+			}
+		case ArgConstant:
+			if !isConstant(arg) {
+				return typeMismatch(arg, "constant")
+			}
+		}
+	}
+
+	node.BaseType = f.BaseType
+	if f.Check != nil {
+		if err := f.Check(node); err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				return &ParseError{ErrorsParsing, []interface{}{f.Name, int32(0)}}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// The arguments of a function node, or nil if any is bottom
+func (node *AST) arguments(n map[string]interface{}) []interface{} {
+	args := make([]interface{}, len(node.Children))
+	for i, child := range node.Children {
+		if re, ok := node.pattern(i); ok {
+			args[i] = re
+		} else if args[i] = child.value(n); args[i] == nil {
+			return nil
+		}
+	}
+	return args
+}
+
+// The compiled pattern passed in place of a wildcard() or regex()
+// argument, if the argument is one
+func (node *AST) pattern(i int) (re *regexp.Regexp, ok bool) {
+	if i == 0 || i > len(node.matchers) {
+		return nil, false
+	}
+	return node.matchers[i-1], true
+}
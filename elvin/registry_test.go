@@ -0,0 +1,197 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package elvin
+
+import (
+	"strings"
+	"testing"
+)
+
+// Register the test functions once for the package's tests
+func init() {
+	// A predicate with a checked, constant second argument
+	if err := RegisterFunction(Function{
+		Name: "test-has-prefix",
+		Args: []int{ArgString, ArgStringConstant},
+		Check: func(node *AST) error {
+			if node.Children[1].Value.(string) == "" {
+				return &ParseError{ErrorsTypeMismatch, []interface{}{"empty string", "prefix", int32(0)}}
+			}
+			return nil
+		},
+		Predicate: func(args []interface{}) int {
+			s, ok := args[0].(string)
+			if !ok {
+				return LukBottom
+			}
+			return lukBool(strings.HasPrefix(s, args[1].(string)))
+		},
+	}); err != nil {
+		panic(err)
+	}
+
+	// A value function of any number of integers
+	if err := RegisterFunction(Function{
+		Name:     "test-sum",
+		Args:     []int{ArgAny},
+		Variadic: true,
+		BaseType: Int32TypeCode,
+		Value: func(args []interface{}) interface{} {
+			var sum int32
+			for _, arg := range args {
+				i, ok := arg.(int32)
+				if !ok {
+					return nil
+				}
+				sum += i
+			}
+			return sum
+		},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterFunctionErrors(t *testing.T) {
+	predicate := func(args []interface{}) int { return LukTrue }
+	value := func(args []interface{}) interface{} { return nil }
+	tests := []Function{
+		{Name: "test-neither", Args: []int{ArgAny}},
+		{Name: "test-both", Args: []int{ArgAny}, Predicate: predicate, Value: value},
+		{Name: "regex", Args: []int{ArgAny}, Predicate: predicate},
+		{Name: "test-has-prefix", Args: []int{ArgAny}, Predicate: predicate},
+		{Name: "", Predicate: predicate},
+		{Name: "two words", Predicate: predicate},
+		{Name: "1st", Predicate: predicate},
+		{Name: "test-bad-arg", Args: []int{42}, Predicate: predicate},
+		{Name: "test-variadic", Variadic: true, Predicate: predicate},
+	}
+
+	for _, f := range tests {
+		if err := RegisterFunction(f); err == nil {
+			t.Errorf("RegisterFunction(%q) succeeded", f.Name)
+		}
+	}
+	if _, ok := LookupFunction("test-neither"); ok {
+		t.Errorf("Failed registration is visible")
+	}
+}
+
+func TestUnregisterFunction(t *testing.T) {
+	predicate := func(args []interface{}) int { return LukTrue }
+	if err := RegisterFunction(Function{Name: "test-unregister", Args: []int{ArgAny}, Predicate: predicate}); err != nil {
+		t.Fatalf("RegisterFunction failed: %v", err)
+	}
+	if err := UnregisterFunction("test-unregister"); err != nil {
+		t.Errorf("UnregisterFunction failed: %v", err)
+	}
+	if _, ok := LookupFunction("test-unregister"); ok {
+		t.Errorf("Unregistered function is visible")
+	}
+	if err := UnregisterFunction("test-unregister"); err == nil {
+		t.Errorf("Unregistering twice succeeded")
+	}
+	if err := UnregisterFunction("regex"); err == nil {
+		t.Errorf("Unregistering a built-in succeeded")
+	}
+}
+
+func TestLookupFunction(t *testing.T) {
+	for _, name := range []string{"require", "regex", "equals", "test-has-prefix"} {
+		if f, ok := LookupFunction(name); !ok || f.Name != name {
+			t.Errorf("LookupFunction(%s) failed", name)
+		}
+	}
+	if _, ok := LookupFunction("no-such-function"); ok {
+		t.Errorf("LookupFunction succeeded for an unknown function")
+	}
+}
+
+func TestCustomFunctions(t *testing.T) {
+	runFunctionTests(t, functionNotification, []evalTest{
+		{"test-has-prefix(GROUP, 'ops.')", LukTrue},
+		{"test-has-prefix(GROUP, 'dev.')", LukFalse},
+		{"test-has-prefix(fold-case(text), 'the')", LukTrue},
+		{"test-has-prefix(missing, 'ops.')", LukBottom},
+		{"!test-has-prefix(GROUP, 'dev.') && number == 42", LukTrue},
+		{"test-sum(number, 8) == 50", LukTrue},
+		{"test-sum(number) > number", LukFalse},
+		{"test-sum(number, missing) == 42", LukBottom},
+		{"test-sum(GROUP) == 42", LukBottom},
+		{"size(GROUP) == test-sum(5, 6)", LukTrue},
+	})
+}
+
+func TestCustomFunctionErrors(t *testing.T) {
+	var parser Parser
+	tests := []struct {
+		expr   string
+		code   uint16
+		offset int
+	}{
+		{"test-has-prefix(GROUP)", ErrorsTooFewArgs, 0},
+		{"test-has-prefix(GROUP, 'a', 'b')", ErrorsParsing, 0},
+		{"a == 1 && test-has-prefix(GROUP, name)", ErrorsTypeMismatch, 10},
+		{"test-has-prefix(42, 'a')", ErrorsTypeMismatch, 0},
+		{"test-has-prefix(GROUP, '')", ErrorsTypeMismatch, 0},
+		{"test-sum() == 1", ErrorsTooFewArgs, 0},
+		{"test-missing(GROUP)", ErrorsUnknownFunction, 0},
+	}
+
+	for _, test := range tests {
+		_, err := parser.Parse(test.expr)
+		parseError, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Parse(%s) returned %v", test.expr, err)
+			continue
+		}
+		if parseError.ErrorCode != test.code || parseError.Offset() != test.offset {
+			t.Errorf("Parse(%s) returned %v, expected code %d at %d", test.expr, err, test.code, test.offset)
+		}
+	}
+}
+
+// Custom functions are formatted, compiled and never folded
+func TestCustomFunctionAST(t *testing.T) {
+	var parser Parser
+	ast, err := parser.Parse("test-has-prefix(GROUP, 'ops.') || test-sum(1, 2) == 3")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if s := Format(ast); s != `test-has-prefix(GROUP, "ops.") || test-sum(1, 2) == 3` {
+		t.Errorf("Format gave %s", s)
+	}
+
+	ast, err = Analyse(ast, DefaultExpressionLimits)
+	if err != nil {
+		t.Fatalf("Analyse failed: %v", err)
+	}
+	if ast.TypeCode != LogicalOrTypeCode {
+		t.Errorf("Custom function folded: %s", Format(ast))
+	}
+
+	predicate := ast.Compile()
+	for _, nfn := range []map[string]interface{}{functionNotification, {"GROUP": "dev"}, {}} {
+		if compiled, interpreted := predicate(nfn), ast.Eval(nfn); compiled != interpreted {
+			t.Errorf("Compiled %d, interpreted %d for %v", compiled, interpreted, nfn)
+		}
+	}
+}
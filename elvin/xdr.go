@@ -446,3 +446,126 @@ func XdrPutKeys(buffer *bytes.Buffer, keyBlock KeyBlock) (err error) {
 	}
 	return nil
 }
+
+// Put an xdr marshalled SubAST, the wire form of a subscription
+// expression. Each node is its type code followed by either its
+// value (names and constants) or its children.
+func XdrPutSubAST(buffer *bytes.Buffer, node *AST) {
+	if node == nil {
+		XdrPutInt32(buffer, EmptyTypeCode)
+		return
+	}
+
+	XdrPutInt32(buffer, int32(node.TypeCode))
+	switch node.TypeCode {
+	case EmptyTypeCode:
+	case NameTypeCode, StringTypeCode:
+		XdrPutString(buffer, node.Value.(string))
+	case Int32TypeCode:
+		XdrPutInt32(buffer, node.Value.(int32))
+	case Int64TypeCode:
+		XdrPutInt64(buffer, node.Value.(int64))
+	case Real64TypeCode:
+		XdrPutFloat64(buffer, node.Value.(float64))
+	default:
+		XdrPutUint32(buffer, uint32(len(node.Children)))
+		for _, child := range node.Children {
+			XdrPutSubAST(buffer, child)
+		}
+	}
+}
+
+// Get an xdr marshalled SubAST. An empty SubAST is returned as nil.
+func XdrGetSubAST(bytes []byte) (node *AST, used int, err error) {
+	offset := 0
+	typeCode, used, err := XdrGetInt32(bytes[offset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += used
+
+	node = &AST{TypeCode: int(typeCode)}
+	switch node.TypeCode {
+	case EmptyTypeCode:
+		return nil, offset, nil
+	case NameTypeCode, StringTypeCode:
+		node.Value, used, err = XdrGetString(bytes[offset:])
+		node.BaseType = node.TypeCode
+	case Int32TypeCode:
+		node.Value, used, err = XdrGetInt32(bytes[offset:])
+		node.BaseType = node.TypeCode
+	case Int64TypeCode:
+		node.Value, used, err = XdrGetInt64(bytes[offset:])
+		node.BaseType = node.TypeCode
+	case Real64TypeCode:
+		node.Value, used, err = XdrGetFloat64(bytes[offset:])
+		node.BaseType = node.TypeCode
+	default:
+		min, max, ok := subASTArity(node.TypeCode)
+		if !ok {
+			return nil, 0, fmt.Errorf("Marshalling failed: unknown SubAST type %d", typeCode)
+		}
+
+		var count uint32
+		count, used, err = XdrGetUint32(bytes[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += used
+		if int64(count) < int64(min) || (max >= 0 && int64(count) > int64(max)) {
+			return nil, 0, fmt.Errorf("Marshalling failed: SubAST type %d has %d children", typeCode, count)
+		}
+
+		for i := uint32(0); i < count; i++ {
+			var child *AST
+			child, used, err = XdrGetSubAST(bytes[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			if child == nil {
+				return nil, 0, errors.New("Marshalling failed: empty SubAST operand")
+			}
+			offset += used
+			node.Children = append(node.Children, child)
+		}
+
+		// Functions are checked and prepared just as when parsed
+		if f, ok := builtinFunction(node.TypeCode); ok {
+			node.Value = f.Name
+			node.function = f
+			if err = checkFunction(node); err != nil {
+				return nil, 0, err
+			}
+		}
+		return node, offset, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += used
+
+	return node, offset, nil
+}
+
+// The minimum and maximum (-1 for unbounded) number of children a
+// SubAST operator or function may have
+func subASTArity(typeCode int) (min int, max int, ok bool) {
+	switch typeCode {
+	case LogicalOrTypeCode, LogicalExclusiveOrTypeCode, LogicalAndTypeCode:
+		return 2, -1, true
+	case LogicalNotTypeCode, UnaryPlusTypeCode, UnaryMinusTypeCode, BinaryNotTypeCode:
+		return 1, 1, true
+	case EqualsTypeCode, NotEqualsTypeCode, LessThanTypeCode, LessThanOrEqualsTypeCode,
+		GreaterThanTypeCode, GreaterThanOrEqualsTypeCode,
+		MultiplyTypeCode, DivideTypeCode, ModuloTypeCode, AddTypeCode, SubtractTypeCode,
+		ShiftLeftTypeCode, ShiftRightTypeCode, LogicalShiftRightTypeCode,
+		BinaryAndTypeCode, BinaryExclusiveOrTypeCode, BinaryOrTypeCode:
+		return 2, 2, true
+	}
+	if f, ok := builtinFunction(typeCode); ok {
+		min, max = f.arity()
+		return min, max, true
+	}
+	return 0, 0, false
+}
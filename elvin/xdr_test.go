@@ -309,6 +309,95 @@ func TestXdrKeys(t *testing.T) {
 
 // Benchmarks
 
+func TestXdrSubAST(t *testing.T) {
+	var parser Parser
+	tests := []string{
+		"a == 1 || b < 2L && !require(c)",
+		"-x * 3.5 >= y % 2 ^^ z << 1 != 0",
+		"wildcard(fold-case(name), \"a*\", \"?b\") && size(name) > 2",
+		"equals(n, 1, 2.0, \"three\") || nan(r)",
+	}
+	nfn := map[string]interface{}{"a": int32(1), "name": "ABC", "n": "three"}
+
+	for _, test := range tests {
+		ast, err := parser.Parse(test)
+		if err != nil {
+			t.Fatalf("Parse(%s) failed: %v", test, err)
+		}
+
+		var buffer = new(bytes.Buffer)
+		XdrPutSubAST(buffer, ast)
+		expected := buffer.Len()
+		ast2, used, err := XdrGetSubAST(buffer.Bytes())
+		if err != nil {
+			t.Fatalf("Unmarshal of %s failed: %v", test, err)
+		}
+		if used != expected {
+			t.Fatalf("Unmarshal of %s used %d of %d bytes", test, used, expected)
+		}
+
+		var buffer2 = new(bytes.Buffer)
+		XdrPutSubAST(buffer2, ast2)
+		if !bytes.Equal(buffer.Bytes(), buffer2.Bytes()) {
+			t.Fatalf("Marshal/Unmarshal of %s differs", test)
+		}
+		if ast.Eval(nfn) != ast2.Eval(nfn) {
+			t.Fatalf("Marshal/Unmarshal of %s evaluates differently", test)
+		}
+	}
+
+	// Empty
+	var buffer = new(bytes.Buffer)
+	XdrPutSubAST(buffer, nil)
+	if ast, used, err := XdrGetSubAST(buffer.Bytes()); ast != nil || used != 4 || err != nil {
+		t.Fatalf("Marshal/Unmarshal of empty SubAST failed: %v %d %v", ast, used, err)
+	}
+
+	// Malformed: an unknown type and an operator missing an operand
+	buffer.Reset()
+	XdrPutInt32(buffer, 99)
+	if _, _, err := XdrGetSubAST(buffer.Bytes()); err == nil {
+		t.Fatalf("Unmarshal of unknown SubAST type succeeded")
+	}
+	buffer.Reset()
+	XdrPutInt32(buffer, EqualsTypeCode)
+	XdrPutUint32(buffer, 1)
+	XdrPutSubAST(buffer, &AST{TypeCode: NameTypeCode, Value: "a"})
+	if _, _, err := XdrGetSubAST(buffer.Bytes()); err == nil {
+		t.Fatalf("Unmarshal of short SubAST operator succeeded")
+	}
+}
+
+func TestXdrSubAddNotify(t *testing.T) {
+	var parser Parser
+	ast, _ := parser.Parse("a == 1")
+	pkt := &SubAddNotify{[]int64{1, 2}, []int64{3}, 42, ast}
+
+	var buffer = new(bytes.Buffer)
+	pkt.Encode(buffer)
+	if PacketID(buffer.Bytes()) != PacketSubAddNotify {
+		t.Fatalf("SubAddNotify encoded as %d", PacketID(buffer.Bytes()))
+	}
+
+	pkt2 := new(SubAddNotify)
+	if err := pkt2.Decode(buffer.Bytes()); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(pkt.SecureQuenchIDs, pkt2.SecureQuenchIDs) ||
+		!reflect.DeepEqual(pkt.InsecureQuenchIDs, pkt2.InsecureQuenchIDs) ||
+		pkt2.TermID != 42 || pkt2.SubExpr == nil || pkt2.SubExpr.TypeCode != EqualsTypeCode {
+		t.Fatalf("Encode/Decode mismatch:\n%v\n%v", pkt, pkt2)
+	}
+
+	del := &SubDelNotify{[]int64{7}, 42}
+	buffer.Reset()
+	del.Encode(buffer)
+	del2 := new(SubDelNotify)
+	if err := del2.Decode(buffer.Bytes()); err != nil || !reflect.DeepEqual(del, del2) {
+		t.Fatalf("Encode/Decode mismatch: %v %v %v", err, del, del2)
+	}
+}
+
 func BenchmarkXdrPutInt32(b *testing.B) {
 	var buf bytes.Buffer
 	for i := 0; i < b.N; i++ {
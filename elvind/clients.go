@@ -30,6 +30,7 @@ import (
 	"io"
 	"math"
 	"math/rand"
+	"net"
 	"sync"
 	"time"
 )
@@ -92,12 +93,18 @@ type Client struct {
 	testConnState  int
 	keysNfn        elvin.KeyBlock
 	keysSub        elvin.KeyBlock
-	writeChannel   chan *bytes.Buffer
+	queue          *deliveryQueue // Packets for the write handler
 	writeTerminate chan int
+	writeDone      chan struct{} // Closed when the write handler exits
 
 	// Configurable options
 	testConnInterval time.Duration
 	testConnTimeout  time.Duration
+	expressionLimits elvin.ExpressionLimits
+	connectionLimits map[string]int
+
+	// Connection options negotiated by ConnRequest
+	options map[string]interface{}
 }
 
 // A buffer pool as we use lots of these for writing to
@@ -119,8 +126,54 @@ func (client *Client) Close() {
 	default:
 	}
 	client.closer.Close()
-	client.channels.remove <- client.ID()
+	client.channels.remove <- client
+
+}
+
+// Queue a packet that mustn't be dropped, such as a reply
+func (client *Client) send(buf *bytes.Buffer) {
+	client.queue.Push(buf)
+}
 
+// Queue a packet sent of the router's own accord, such as a
+// notification, subject to the client's drop policy. A client whose
+// policy is to fail rather than drop is disconnected.
+func (client *Client) deliver(buf *bytes.Buffer) {
+	if !client.queue.Deliver(buf) {
+		client.elog.Logf(elog.LogLevelInfo1, "Closing client %d as its receive queue is full", client.ID())
+		client.closer.Close()
+	}
+}
+
+// Send a Disconn as the last packet to the client and wait a while
+// for the write handler to send it
+func (client *Client) disconn(reason uint32, args string) {
+	disconn := new(elvin.Disconn)
+	disconn.Reason = reason
+	disconn.Args = args
+	buf := bufferPool.Get().(*bytes.Buffer)
+	disconn.Encode(buf)
+	client.queue.PushLast(buf)
+
+	select {
+	case <-client.writeDone:
+	case <-time.After(disconnTimeout):
+	}
+}
+
+// How long to wait for a Disconn to be written
+const disconnTimeout = 5 * time.Second
+
+// Send a Nack
+func (client *Client) nack(xid uint32, errorCode uint16, args ...interface{}) {
+	nack := new(elvin.Nack)
+	nack.XID = xid
+	nack.ErrorCode = errorCode
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	nack.Args = args
+	buf := bufferPool.Get().(*bytes.Buffer)
+	nack.Encode(buf)
+	client.send(buf)
 }
 
 // Read n bytes from reader into buffer which must be big enough
@@ -156,6 +209,12 @@ func (client *Client) readHandler() {
 
 		// Read the protocol packet, starting with it's length
 		packetSize := int(binary.BigEndian.Uint32(header))
+		if packetSize > client.limit("Packet.Max-Length") {
+			client.elog.Logf(elog.LogLevelInfo1, "Disconnecting client %d for sending a %d byte packet", client.ID(), packetSize)
+			client.disconn(elvin.DisconnReasonRouterProtocolErrors, "Packet.Max-Length exceeded")
+			break
+		}
+
 		// Grow our buffer if needed
 		if packetSize > len(buffer) {
 			client.elog.Logf(elog.LogLevelDebug2, "Growing buffer to %d bytes", packetSize)
@@ -181,6 +240,7 @@ func (client *Client) readHandler() {
 func (client *Client) writeHandler() {
 	client.elog.Logf(elog.LogLevelDebug1, "Write Handler starting")
 	defer client.elog.Logf(elog.LogLevelDebug1, "Write Handler exiting")
+	defer close(client.writeDone)
 
 	header := make([]byte, 4)
 
@@ -206,29 +266,33 @@ func (client *Client) writeHandler() {
 	// It runs a Test/ConfConn timer if configured
 	for {
 		select {
-		case buffer := <-client.writeChannel:
-
-			// Write the frame header (packetsize)
-			binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
-			_, err := client.writer.Write(header)
-			if err != nil {
-				// Deal with more errors
-				if err != io.EOF {
-					client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
+		case <-client.queue.ready:
+			for _, buffer := range client.queue.Take() {
+				// Write the frame header (packetsize)
+				binary.BigEndian.PutUint32(header, uint32(buffer.Len()))
+				_, err := client.writer.Write(header)
+				if err != nil {
+					// Deal with more errors
+					if err != io.EOF {
+						client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
+					}
+					bufferPool.Put(buffer)
+					return // We're done, cleanup done by read
 				}
-				bufferPool.Put(buffer)
-				return // We're done, cleanup done by read
-			}
 
-			// Write the packet
-			_, err = buffer.WriteTo(client.writer)
-			if err != nil {
-				// Deal with more errors
-				if err != io.EOF {
-					client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
+				// Write the packet
+				_, err = buffer.WriteTo(client.writer)
+				if err != nil {
+					// Deal with more errors
+					if err != io.EOF {
+						client.elog.Logf(elog.LogLevelError, "Unexpected write error: %v", err)
+					}
+					bufferPool.Put(buffer)
+					return // We're done, cleanup done by read
 				}
-				bufferPool.Put(buffer)
-				return // We're done, cleanup done by read
+			}
+			if client.queue.Drained() {
+				return // The last packet's gone, cleanup done by read
 			}
 		case <-client.writeTerminate:
 			return // We're done, cleanup done by read
@@ -243,7 +307,7 @@ func (client *Client) writeHandler() {
 				testConn := new(elvin.TestConn)
 				writeBuf := new(bytes.Buffer)
 				testConn.Encode(writeBuf)
-				client.writeChannel <- writeBuf
+				client.send(writeBuf)
 			case TestConnAwaitingResponse:
 				client.elog.Logf(elog.LogLevelInfo1, "Closing client %d for not responding to TestConn", client.ID())
 				// FIXME:Close the socket to trigger read exit
@@ -329,9 +393,9 @@ func (client *Client) HandlePacket(buffer []byte) (err error) {
 		case elvin.PacketDisconn:
 			return errors.New("FIXME: Packet Disconn")
 		case elvin.PacketSecRequest:
-			return errors.New("FIXME: Packet SecRequest")
+			return client.HandleSecRequest(buffer)
 		case elvin.PacketSecReply:
-			return errors.New("FIXME: Packet SecReply")
+			return fmt.Errorf("ProtocolError: %s received", elvin.PacketIDString(elvin.PacketID(buffer)))
 		case elvin.PacketNotifyEmit:
 			return client.HandleNotifyEmit(buffer)
 		case elvin.PacketSubAddRequest:
@@ -404,7 +468,7 @@ func (client *Client) HandleConnRequest(buffer []byte) (err error) {
 		nack.Args = nil
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 		return nil
 	}
 	if _, ok := connRequest.Options["TestDisconn"]; ok {
@@ -413,9 +477,20 @@ func (client *Client) HandleConnRequest(buffer []byte) (err error) {
 		disconn.Reason = 4 // a little bogus
 		buf := bufferPool.Get().(*bytes.Buffer)
 		disconn.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
+		return nil
+	}
+
+	options, nack := negotiateOptions(connRequest.Options, client.connectionLimits)
+	if nack != nil {
+		client.elog.Logf(elog.LogLevelInfo1, "Rejecting connection options: %v", nack)
+		nack.XID = connRequest.XID
+		buf := bufferPool.Get().(*bytes.Buffer)
+		nack.Encode(buf)
+		client.send(buf)
 		return nil
 	}
+	client.applyOptions(options)
 
 	// We're now connected
 	client.SetState(StateConnected)
@@ -431,19 +506,28 @@ func (client *Client) HandleConnRequest(buffer []byte) (err error) {
 	// Respond with a ConnReply
 	connReply := new(elvin.ConnReply)
 	connReply.XID = connRequest.XID
-	// FIXME; totally bogus
-	connReply.Options = connRequest.Options
+	connReply.Options = options
 
 	client.elog.Logf(elog.LogLevelInfo1, "New client %d connected", client.ID())
 
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	connReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 
 	return nil
 }
 
+// Use a client's negotiated connection options
+func (client *Client) applyOptions(options map[string]interface{}) {
+	client.options = options
+	client.queue.Configure(int(options["Receive-Queue.Max-Length"].(int32)),
+		dropPolicies[options["Receive-Queue.Drop-Policy"].(string)])
+	if conn, ok := client.closer.(*net.TCPConn); ok {
+		conn.SetNoDelay(options["TCP.Send-Immediately"].(int32) == 1)
+	}
+}
+
 // Handle a Disclient Request
 func (client *Client) HandleDisconnRequest(buffer []byte) (err error) {
 
@@ -464,15 +548,73 @@ func (client *Client) HandleDisconnRequest(buffer []byte) (err error) {
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	DisconnReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 
-	for subID, _ := range client.subs {
-		// FIXME: send subscription removal to sub engine
-		delete(client.subs, subID)
+	// Removing the client deletes its subscriptions and quenches
+	client.channels.remove <- client
+
+	return nil
+}
+
+// The connection's notification and subscription keys (synchronized)
+func (client *Client) connectionKeys() (keysNfn, keysSub elvin.KeyBlock) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.keysNfn, client.keysSub
+}
+
+// Handle a Security Request
+func (client *Client) HandleSecRequest(buffer []byte) (err error) {
+	secRequest := new(elvin.SecRequest)
+	if err = secRequest.Decode(buffer); err != nil {
+		return err
+	}
+
+	PrimeProducer(secRequest.AddNfnKeys)
+	PrimeProducer(secRequest.DelNfnKeys)
+	PrimeConsumer(secRequest.AddSubKeys)
+	PrimeConsumer(secRequest.DelSubKeys)
+
+	// Nothing changes unless everything can
+	keysNfn, keysSub := client.connectionKeys()
+	for _, change := range []struct {
+		keys, add, del elvin.KeyBlock
+	}{
+		{keysNfn, secRequest.AddNfnKeys, secRequest.DelNfnKeys},
+		{keysSub, secRequest.AddSubKeys, secRequest.DelSubKeys},
+	} {
+		if found, _ := keyBlockFind(change.keys, change.add); found > 0 {
+			client.nack(secRequest.XID, elvin.ErrorsKeyExists)
+			return nil
+		}
+		if found, total := keyBlockFind(change.keys, change.del); found < total {
+			client.nack(secRequest.XID, elvin.ErrorsNoSuchKey)
+			return nil
+		}
 	}
 
-	client.channels.remove <- client.ID()
+	// The router may be matching against the current keys so
+	// change copies of them
+	keysNfn = elvin.KeyBlockCopy(keysNfn)
+	elvin.KeyBlockAddKeys(keysNfn, secRequest.AddNfnKeys)
+	elvin.KeyBlockDeleteKeys(keysNfn, secRequest.DelNfnKeys)
+	keysSub = elvin.KeyBlockCopy(keysSub)
+	elvin.KeyBlockAddKeys(keysSub, secRequest.AddSubKeys)
+	elvin.KeyBlockDeleteKeys(keysSub, secRequest.DelSubKeys)
 
+	client.mu.Lock()
+	client.keysNfn = keysNfn
+	client.keysSub = keysSub
+	client.mu.Unlock()
+	client.channels.keysMod <- client
+
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d changed connection keys", client.ID())
+
+	secReply := new(elvin.SecReply)
+	secReply.XID = secRequest.XID
+	buf := bufferPool.Get().(*bytes.Buffer)
+	secReply.Encode(buf)
+	client.send(buf)
 	return nil
 }
 
@@ -482,11 +624,11 @@ func (client *Client) HandleTestConn(buffer []byte) (err error) {
 	client.elog.Logf(elog.LogLevelInfo2, "Received TestConn", client.ID())
 
 	// Only respond is there are no queued packets
-	if len(client.writeChannel) > 1 {
+	if client.queue.Len() > 1 {
 		confConn := new(elvin.ConfConn)
 		writeBuf := new(bytes.Buffer)
 		confConn.Encode(writeBuf)
-		client.writeChannel <- writeBuf
+		client.send(writeBuf)
 	}
 
 	return nil
@@ -507,6 +649,10 @@ func (client *Client) HandleNotifyEmit(buffer []byte) (err error) {
 	if err = ne.Decode(buffer); err != nil {
 		return err
 	}
+	if !client.checkAttributes(ne.NameValue) {
+		return nil
+	}
+	PrimeProducer(ne.Keys)
 
 	client.channels.notify <- Notification{client.keysNfn, ne.NameValue, ne.DeliverInsecure, ne.Keys}
 	return nil
@@ -520,11 +666,27 @@ func (client *Client) HandleUNotify(buffer []byte) (err error) {
 	}
 
 	// FIXME: Check version and ?
+	if !client.checkAttributes(unotify.NameValue) {
+		return nil
+	}
+	PrimeProducer(unotify.Keys)
 
 	client.channels.notify <- Notification{client.keysNfn, unotify.NameValue, unotify.DeliverInsecure, unotify.Keys}
 	return nil
 }
 
+// Check a notification has no more than Attribute.Max-Count
+// attributes. As a notification has no XID the Nack for one that
+// doesn't has none either.
+func (client *Client) checkAttributes(nameValue map[string]interface{}) bool {
+	if len(nameValue) <= client.limit("Attribute.Max-Count") {
+		return true
+	}
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d dropping notification with %d attributes", client.ID(), len(nameValue))
+	client.nack(0, elvin.ErrorsQOSLimit, "Attribute.Max-Count")
+	return false
+}
+
 // Handle a Subscription Add
 func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 	subRequest := new(elvin.SubAddRequest)
@@ -533,12 +695,18 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 		// FIXME: Protocol violation
 	}
 
-	ast, nack := Parse(subRequest.Expression)
+	if len(client.subs) >= client.limit("Subscription.Max-Count") ||
+		len(subRequest.Expression) > client.limit("Subscription.Max-Length") {
+		client.nack(subRequest.XID, elvin.ErrorsImplementationLimit)
+		return nil
+	}
+
+	ast, nack := Parse(subRequest.Expression, client.expressionLimits)
 	if nack != nil {
 		nack.XID = subRequest.XID
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 		return nil
 	}
 
@@ -567,12 +735,12 @@ func (client *Client) HandleSubAddRequest(buffer []byte) (err error) {
 	subReply := new(elvin.SubReply)
 	subReply.XID = subRequest.XID
 	subReply.SubID = sub.SubID
-	client.elog.Logf(elog.LogLevelInfo2, "Client:%d New subscription:%d (%d)", client.ID(), s, sub.SubID)
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d New subscription:%d (%d) %s", client.ID(), s, sub.SubID, sub.Ast)
 
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	subReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 	return nil
 }
 
@@ -596,7 +764,7 @@ func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 		nack.Args[0] = subDelRequest.SubID
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 
 		// FIXME Disconnect as that's a protocol violation
 		return nil
@@ -616,7 +784,7 @@ func (client *Client) HandleSubDelRequest(buffer []byte) (err error) {
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	subReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 	return nil
 }
 
@@ -641,45 +809,50 @@ func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 
 		// FIXME Disconnect if that's a repeated protocol violation?
 		return nil
 	}
 
-	// FIXME: At some point this sub will need a lock but for now it's all handled in the read goroutine
-	// FIXME: And any update to the sub should be all or nothing
+	// The router may still be evaluating the subscription so the
+	// changes are made to a new one, with the same SubID, which
+	// replaces it once they've all been checked
+	modified := &Subscription{SubID: sub.SubID, Keys: sub.Keys, Ast: sub.Ast}
 
 	// Check the subscription expression. Empty is ok. Incorrect means bail.
 	if len(subModRequest.Expression) > 0 {
-		ast, nack := Parse(subModRequest.Expression)
+		if len(subModRequest.Expression) > client.limit("Subscription.Max-Length") {
+			client.nack(subModRequest.XID, elvin.ErrorsImplementationLimit)
+			return nil
+		}
+		ast, nack := Parse(subModRequest.Expression, client.expressionLimits)
 		if nack != nil {
 			nack.XID = subModRequest.XID
 			buf := bufferPool.Get().(*bytes.Buffer)
 			nack.Encode(buf)
-			client.writeChannel <- buf
+			client.send(buf)
 			return nil
 		}
-		sub.Ast = ast
+		modified.Ast = ast
+		client.elog.Logf(elog.LogLevelInfo2, "Client:%d Modified subscription:%d %s", client.ID(), sub.SubID, modified.Ast)
 	}
 
 	// AcceptInsecure is the only piece that must have a value - and it is allowed to be the same
-	sub.AcceptInsecure = subModRequest.AcceptInsecure
+	modified.AcceptInsecure = subModRequest.AcceptInsecure
 
-	// Merge in any new keys
-	if len(subModRequest.AddKeys) > 0 {
+	// Merge in any new keys and remove any old ones from a copy
+	if len(subModRequest.AddKeys) > 0 || len(subModRequest.DelKeys) > 0 {
 		PrimeConsumer(subModRequest.AddKeys)
-		elvin.KeyBlockAddKeys(sub.Keys, subModRequest.AddKeys)
-	}
-
-	// Remove any old keys
-	if len(subModRequest.DelKeys) > 0 {
 		PrimeConsumer(subModRequest.DelKeys)
-		elvin.KeyBlockDeleteKeys(sub.Keys, subModRequest.DelKeys)
+		modified.Keys = elvin.KeyBlockCopy(sub.Keys)
+		elvin.KeyBlockAddKeys(modified.Keys, subModRequest.AddKeys)
+		elvin.KeyBlockDeleteKeys(modified.Keys, subModRequest.DelKeys)
 	}
 
-	// Send it to the subscription engine
-	client.channels.subMod <- sub
+	// Send it to the subscription engine to compile
+	client.subs[idx] = modified
+	client.channels.subMod <- modified
 
 	// Respond with a SubReply
 	subReply := new(elvin.SubReply)
@@ -689,7 +862,7 @@ func (client *Client) HandleSubModRequest(buffer []byte) (err error) {
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	subReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 	return nil
 }
 
@@ -711,6 +884,7 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 	}
 	quench.DeliverInsecure = quenchRequest.DeliverInsecure
 	quench.Keys = quenchRequest.Keys
+	PrimeProducer(quench.Keys)
 
 	// Create a unique quench id
 	var q int32 = rand.Int31()
@@ -724,9 +898,6 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 	client.quenches[q] = &quench
 	quench.QuenchID = (int64(client.ID()) << 32) | int64(q)
 
-	// send quench to sub engine
-	client.channels.quenchAdd <- &quench
-
 	// Respond with a QuenchReply
 	quenchReply := new(elvin.QuenchReply)
 	quenchReply.XID = quenchRequest.XID
@@ -736,7 +907,11 @@ func (client *Client) HandleQuenchAddRequest(buffer []byte) (err error) {
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	quenchReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
+
+	// send quench to sub engine only once the reply is queued, as
+	// the client can't use SubAddNotifies for a quench it doesn't know
+	client.channels.quenchAdd <- &quench
 	return nil
 }
 
@@ -760,35 +935,51 @@ func (client *Client) HandleQuenchModRequest(buffer []byte) (err error) {
 
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 
 		// FIXME Disconnect if that's a repeated protocol violation?
 		return nil
 	}
 
+	// The router may be using the quench so, as for subscriptions,
+	// the changes are made to a new one which replaces it
+	modified := &Quench{QuenchID: quench.QuenchID, Keys: quench.Keys}
+	modified.Names = make(map[string]bool)
+	for name := range quench.Names {
+		modified.Names[name] = true
+	}
 	for name, _ := range quenchModRequest.AddNames {
-		quench.Names[name] = true
+		modified.Names[name] = true
 	}
 	for name, _ := range quenchModRequest.DelNames {
-		delete(quench.Names, name)
+		delete(modified.Names, name)
+	}
+	modified.DeliverInsecure = quenchModRequest.DeliverInsecure
+
+	// Merge in any new keys and remove any old ones from a copy
+	if len(quenchModRequest.AddKeys) > 0 || len(quenchModRequest.DelKeys) > 0 {
+		PrimeProducer(quenchModRequest.AddKeys)
+		PrimeProducer(quenchModRequest.DelKeys)
+		modified.Keys = elvin.KeyBlockCopy(quench.Keys)
+		elvin.KeyBlockAddKeys(modified.Keys, quenchModRequest.AddKeys)
+		elvin.KeyBlockDeleteKeys(modified.Keys, quenchModRequest.DelKeys)
 	}
-	quench.DeliverInsecure = quenchModRequest.DeliverInsecure
-	// FIXME: implement key changes
 
 	// send quench to sub engine
-	client.channels.quenchMod <- quench
+	client.quenches[idx] = modified
+	client.channels.quenchMod <- modified
 
 	// Respond with a QuenchReply
 	quenchReply := new(elvin.QuenchReply)
 	quenchReply.XID = quenchModRequest.XID
-	quenchReply.QuenchID = quench.QuenchID
+	quenchReply.QuenchID = modified.QuenchID
 
-	client.elog.Logf(elog.LogLevelInfo2, "Client:%d  quench:%d modified %+v", client.ID(), quench.QuenchID, quench)
+	client.elog.Logf(elog.LogLevelInfo2, "Client:%d  quench:%d modified %+v", client.ID(), modified.QuenchID, modified)
 
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	quenchReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 	return nil
 }
 
@@ -811,7 +1002,7 @@ func (client *Client) HandleQuenchDelRequest(buffer []byte) (err error) {
 		nack.Args[0] = quenchDelRequest.QuenchID
 		buf := bufferPool.Get().(*bytes.Buffer)
 		nack.Encode(buf)
-		client.writeChannel <- buf
+		client.send(buf)
 
 		// FIXME Disconnect as that's a protocol violation
 		return nil
@@ -831,6 +1022,6 @@ func (client *Client) HandleQuenchDelRequest(buffer []byte) (err error) {
 	// Encode that into a buffer for the write handler
 	buf := bufferPool.Get().(*bytes.Buffer)
 	quenchReply.Encode(buf)
-	client.writeChannel <- buf
+	client.send(buf)
 	return nil
 }
@@ -24,6 +24,7 @@ package main
 import (
 	"encoding/json"
 	"github.com/cobaro/elvin/elog"
+	"github.com/cobaro/elvin/elvin"
 	"os"
 )
 
@@ -36,6 +37,18 @@ type Configuration struct {
 	TestConnTimeout  int64 // Time to await a response
 	LogLevel         int
 	LogDateFormat    int
+
+	// Subscription expression limits, 0 for none
+	MaxExpressionDepth int
+	MaxExpressionNodes int
+	MaxRegexpSize      int
+
+	// Limits on connection options clients may negotiate, such
+	// as Subscription.Max-Count, by option name
+	ConnectionLimits map[string]int
+
+	// Go plugins exporting custom subscription functions
+	FunctionPlugins []string
 }
 
 func LoadConfig(configFile string) (config *Configuration, err error) {
@@ -61,6 +74,9 @@ func DefaultConfig() (config *Configuration) {
 	config.TestConnTimeout = 10
 	config.LogLevel = elog.LogLevelInfo1
 	config.LogDateFormat = elog.LogDateLocaltime
+	config.MaxExpressionDepth = elvin.DefaultExpressionLimits.MaxDepth
+	config.MaxExpressionNodes = elvin.DefaultExpressionLimits.MaxNodes
+	config.MaxRegexpSize = elvin.DefaultExpressionLimits.MaxRegexpSize
 	// config.Logfile = os.Stderr
 
 	return config
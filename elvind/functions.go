@@ -0,0 +1,77 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"plugin"
+)
+
+// The symbol a function plugin exports, a []elvin.Function. Plugins
+// are built with go build -buildmode=plugin against the same elvin
+// package as the router, for example:
+//
+//	package main
+//
+//	var Functions = []elvin.Function{
+//		{Name: "cidr-contains", Args: []int{elvin.ArgString, elvin.ArgStringConstant}, ...},
+//	}
+const functionsSymbol = "Functions"
+
+// Load each plugin, registering the custom subscription functions it
+// exports. Loading continues past a failure and the failures are
+// returned.
+func LoadFunctions(paths []string) (errs []error) {
+	for _, path := range paths {
+		if err := loadFunctions(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Load one plugin's functions
+func loadFunctions(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	symbol, err := p.Lookup(functionsSymbol)
+	if err != nil {
+		return err
+	}
+	functions, ok := symbol.(*[]elvin.Function)
+	if !ok {
+		return fmt.Errorf("%s: %s is a %T not a []elvin.Function", path, functionsSymbol, symbol)
+	}
+	return registerFunctions(path, *functions)
+}
+
+// Register functions loaded from path
+func registerFunctions(path string, functions []elvin.Function) error {
+	for _, f := range functions {
+		if err := elvin.RegisterFunction(f); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
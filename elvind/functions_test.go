@@ -0,0 +1,58 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+)
+
+func TestLoadFunctions(t *testing.T) {
+	if errs := LoadFunctions([]string{"/nonexistent/functions.so"}); len(errs) != 1 {
+		t.Errorf("Expected one error loading a missing plugin: %v", errs)
+	}
+
+	functions := []elvin.Function{{
+		Name: "elvind-test-even",
+		Args: []int{elvin.ArgAny},
+		Predicate: func(args []interface{}) int {
+			if i, ok := args[0].(int32); ok && i%2 == 0 {
+				return elvin.LukTrue
+			}
+			return elvin.LukFalse
+		},
+	}}
+	if err := registerFunctions("test", functions); err != nil {
+		t.Fatalf("registerFunctions failed: %v", err)
+	}
+	defer elvin.UnregisterFunction("elvind-test-even")
+	if err := registerFunctions("test", functions); err == nil {
+		t.Errorf("Registering twice succeeded")
+	}
+
+	ast, nack := Parse("elvind-test-even(Level)", elvin.DefaultExpressionLimits)
+	if nack != nil {
+		t.Fatalf("Parse failed: %v", nack)
+	}
+	if !ast.Match(map[string]interface{}{"Level": int32(4)}) {
+		t.Errorf("Registered function didn't match")
+	}
+}
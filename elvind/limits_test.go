@@ -0,0 +1,162 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketLimit(t *testing.T) {
+	protocol, _ := elvin.URLToProtocol(testURL)
+	conn, err := net.Dial(protocol.Network, protocol.Address)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Announce a packet one byte over the default limit
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, megabyte+1)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// And we're sent a Disconn before being closed
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	buffer := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	disconn := new(elvin.Disconn)
+	if elvin.PacketID(buffer) != elvin.PacketDisconn || disconn.Decode(buffer) != nil {
+		t.Fatalf("Received %s", elvin.PacketIDString(elvin.PacketID(buffer)))
+	}
+	if disconn.Reason != elvin.DisconnReasonRouterProtocolErrors {
+		t.Errorf("Disconn reason %d", disconn.Reason)
+	}
+	if _, err := conn.Read(header); err != io.EOF {
+		t.Errorf("Connection not closed: %v", err)
+	}
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	c := elvin.NewClient(testURL, map[string]interface{}{"Subscription.Max-Count": int32(16)}, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	limited := fmt.Sprintf("[%d]", elvin.ErrorsImplementationLimit)
+
+	// Subscription.Max-Length
+	sub := new(elvin.Subscription)
+	sub.Expression = fmt.Sprintf("TestLimits == '%s'", strings.Repeat("x", 2*kilobyte))
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := c.Subscribe(sub); err == nil || !strings.Contains(err.Error(), limited) {
+		t.Errorf("Subscribe returned %v", err)
+	}
+
+	// Subscription.Max-Count
+	for i := 0; i < 17; i++ {
+		sub := new(elvin.Subscription)
+		sub.Expression = fmt.Sprintf("TestLimits == %d", i)
+		sub.AcceptInsecure = true
+		sub.Notifications = make(chan map[string]interface{})
+		err := c.Subscribe(sub)
+		if i < 16 && err != nil {
+			t.Fatalf("Subscribe %d failed: %v", i, err)
+		}
+		if i == 16 && (err == nil || !strings.Contains(err.Error(), limited)) {
+			t.Errorf("Subscribe %d returned %v", i, err)
+		}
+		if i == 0 {
+			long := fmt.Sprintf("TestLimits == '%s'", strings.Repeat("x", 2*kilobyte))
+			if err := c.SubscriptionModify(sub, long, true, nil, nil); err == nil || !strings.Contains(err.Error(), limited) {
+				t.Errorf("SubscriptionModify returned %v", err)
+			}
+		}
+	}
+}
+
+func TestAttributeLimit(t *testing.T) {
+	c := elvin.NewClient(testURL, map[string]interface{}{"Attribute.Max-Count": int32(16)}, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	events := make(chan elvin.Packet, 1)
+	go func() {
+		events <- <-c.Events
+	}()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestAttributeLimit)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer client.SubscriptionDelete(sub)
+
+	nfn := map[string]interface{}{"TestAttributeLimit": int32(0)}
+	for i := 1; i < 17; i++ {
+		nfn[fmt.Sprintf("a%d", i)] = int32(i)
+	}
+	if err := c.Notify(nfn, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	select {
+	case event := <-events:
+		nack, ok := event.(*elvin.Nack)
+		if !ok || nack.ErrorCode != elvin.ErrorsQOSLimit || nack.XID != 0 {
+			t.Errorf("Received %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No Nack received")
+	}
+
+	// One attribute fewer is delivered
+	delete(nfn, "a16")
+	if err := c.Notify(nfn, true, nil); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	select {
+	case received := <-sub.Notifications:
+		if len(received) != 16 {
+			t.Errorf("Received %v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No notification received")
+	}
+}
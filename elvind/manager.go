@@ -58,6 +58,15 @@ func main() {
 	manager.router.SetDoFailover(manager.config.DoFailover)
 	manager.router.SetTestConnInterval(time.Duration(manager.config.TestConnInterval) * time.Second)
 	manager.router.SetTestConnTimeout(time.Duration(manager.config.TestConnTimeout) * time.Second)
+	manager.router.SetExpressionLimits(elvin.ExpressionLimits{
+		MaxDepth:      manager.config.MaxExpressionDepth,
+		MaxNodes:      manager.config.MaxExpressionNodes,
+		MaxRegexpSize: manager.config.MaxRegexpSize,
+	})
+	manager.router.SetConnectionLimits(manager.config.ConnectionLimits)
+	for _, e := range LoadFunctions(manager.config.FunctionPlugins) {
+		manager.router.elog.Logf(elog.LogLevelError, "Can't load functions: %v", e)
+	}
 
 	manager.protocols = make(map[string]*elvin.Protocol)
 	for _, url := range manager.config.Protocols {
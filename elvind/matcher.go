@@ -0,0 +1,317 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"math"
+	"sync"
+)
+
+// The Matcher indexes subscriptions so that a notification need only
+// be evaluated against those that could plausibly match it.
+//
+// Each subscription is reduced to a set of anchors, at least one of
+// which any matching notification must satisfy. An anchor is either an
+// attribute name that must be present, or an attribute name and a
+// constant it must be equal to. For example:
+//
+//	Group == 3 && Level > 2     anchored on {Group == 3}
+//	require(a) || b < 4         anchored on {a, b}
+//	!require(a)                 no anchors, always evaluated
+//
+// Anchors are only an approximation so candidates must still be fully
+// evaluated. The index is maintained by the Subscriptions goroutine and
+// read by the Notify goroutine, which may still be evaluating a
+// subscription after it is modified or deleted. Subscriptions are
+// therefore indexed by SubID and never changed once added, a modified
+// subscription being a new one replacing the old.
+type Matcher struct {
+	mu      sync.RWMutex
+	index   map[anchor]map[int64]*Subscription // Anchored subscriptions
+	always  map[int64]*Subscription            // Subscriptions with no anchors
+	anchors map[int64][]anchor                 // To remove a subscription
+}
+
+// An attribute name with a nil value must be present, otherwise it
+// must be equal to the value
+type anchor struct {
+	name  string
+	value interface{}
+}
+
+// Opaques are indexed by their contents, as a distinct type from strings
+type opaqueKey string
+
+// Anchors that are only a name are much less selective than those
+// with a value so cost more when choosing amongst conjuncts
+const nameAnchorCost = 1000
+
+// Matcher initialization
+func (m *Matcher) Init() {
+	m.index = make(map[anchor]map[int64]*Subscription)
+	m.always = make(map[int64]*Subscription)
+	m.anchors = make(map[int64][]anchor)
+}
+
+// Add a subscription to the index
+func (m *Matcher) Add(sub *Subscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(sub)
+}
+
+// Replace the subscription with the same SubID, reindexing it as its
+// expression may have changed
+func (m *Matcher) Modify(sub *Subscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(sub)
+	m.add(sub)
+}
+
+// Remove a subscription from the index
+func (m *Matcher) Delete(sub *Subscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delete(sub)
+}
+
+// The number of subscriptions indexed
+func (m *Matcher) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.anchors)
+}
+
+// Return the subscriptions that could match a notification. Each is
+// returned once and all still require a full evaluation.
+func (m *Matcher) Candidates(nv map[string]interface{}) (candidates []*Subscription) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, sub := range m.always {
+		candidates = append(candidates, sub)
+	}
+
+	seen := make(map[int64]bool)
+	collect := func(a anchor) {
+		for id, sub := range m.index[a] {
+			if !seen[id] {
+				seen[id] = true
+				candidates = append(candidates, sub)
+			}
+		}
+	}
+
+	for name, v := range nv {
+		collect(anchor{name, nil})
+		if key := valueKey(v); key != nil {
+			collect(anchor{name, key})
+		}
+	}
+	return candidates
+}
+
+func (m *Matcher) add(sub *Subscription) {
+	var anchors []anchor
+	if sub.Ast != nil {
+		anchors, _ = anchorsOf(sub.Ast)
+	}
+	if len(anchors) == 0 {
+		m.always[sub.SubID] = sub
+		m.anchors[sub.SubID] = nil
+		return
+	}
+
+	for _, a := range anchors {
+		subs, ok := m.index[a]
+		if !ok {
+			subs = make(map[int64]*Subscription)
+			m.index[a] = subs
+		}
+		subs[sub.SubID] = sub
+	}
+	m.anchors[sub.SubID] = anchors
+}
+
+func (m *Matcher) delete(sub *Subscription) {
+	anchors, ok := m.anchors[sub.SubID]
+	if !ok {
+		return
+	}
+	for _, a := range anchors {
+		delete(m.index[a], sub.SubID)
+		if len(m.index[a]) == 0 {
+			delete(m.index, a)
+		}
+	}
+	delete(m.always, sub.SubID)
+	delete(m.anchors, sub.SubID)
+}
+
+// The index key for a notification or constant value. Numbers are
+// compared after promotion so all are keyed as reals. Returns nil for
+// values that can't be indexed (including NaN which equals nothing).
+func valueKey(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		if math.IsNaN(v) {
+			return nil
+		}
+		return v
+	case string:
+		return v
+	case []byte:
+		return opaqueKey(v)
+	}
+	return nil
+}
+
+// Find the anchors for an expression, returning false if there are
+// none (i.e., the expression may be true of any notification).
+func anchorsOf(node *elvin.AST) ([]anchor, bool) {
+	switch node.TypeCode {
+	case elvin.LogicalAndTypeCode:
+		// Any one conjunct's anchors will do so pick the cheapest
+		var best []anchor
+		bestCost := -1
+		for _, child := range node.Children {
+			anchors, ok := anchorsOf(child)
+			if !ok {
+				continue
+			}
+			if cost := anchorsCost(anchors); bestCost < 0 || cost < bestCost {
+				best, bestCost = anchors, cost
+			}
+		}
+		return best, best != nil
+
+	case elvin.LogicalOrTypeCode:
+		// Each disjunct must be anchored
+		var all []anchor
+		for _, child := range node.Children {
+			anchors, ok := anchorsOf(child)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, anchors...)
+		}
+		return all, true
+
+	case elvin.EqualsTypeCode:
+		if a, ok := equalityAnchor(node.Children[0], node.Children[1]); ok {
+			return []anchor{a}, true
+		}
+		if a, ok := equalityAnchor(node.Children[1], node.Children[0]); ok {
+			return []anchor{a}, true
+		}
+		return nameAnchors(node.Children...)
+
+	case elvin.NotEqualsTypeCode, elvin.LessThanTypeCode, elvin.LessThanOrEqualsTypeCode,
+		elvin.GreaterThanTypeCode, elvin.GreaterThanOrEqualsTypeCode:
+		return nameAnchors(node.Children...)
+
+	case elvin.FuncEqualsTypeCode:
+		var anchors []anchor
+		for _, arg := range node.Children[1:] {
+			a, ok := equalityAnchor(node.Children[0], arg)
+			if !ok {
+				return nameAnchors(node.Children[0])
+			}
+			anchors = append(anchors, a)
+		}
+		return anchors, true
+
+	case elvin.FuncRequireTypeCode,
+		elvin.FuncBeginsWithTypeCode, elvin.FuncContainsTypeCode, elvin.FuncEndsWithTypeCode,
+		elvin.FuncWildcardTypeCode, elvin.FuncRegexTypeCode,
+		elvin.FuncInt32TypeCode, elvin.FuncInt64TypeCode, elvin.FuncReal64TypeCode,
+		elvin.FuncStringTypeCode, elvin.FuncOpaqueTypeCode, elvin.FuncNanTypeCode:
+		return nameAnchors(node.Children[0])
+	}
+
+	// Not, Xor and constants can be true without any attributes
+	return nil, false
+}
+
+// An anchor for name == constant
+func equalityAnchor(name, constant *elvin.AST) (anchor, bool) {
+	if name.TypeCode != elvin.NameTypeCode {
+		return anchor{}, false
+	}
+	switch constant.TypeCode {
+	case elvin.Int32TypeCode, elvin.Int64TypeCode, elvin.Real64TypeCode, elvin.StringTypeCode:
+		if key := valueKey(constant.Value); key != nil {
+			return anchor{name.Value.(string), key}, true
+		}
+	}
+	return anchor{}, false
+}
+
+// An anchor on the first of the values that requires an attribute
+func nameAnchors(values ...*elvin.AST) ([]anchor, bool) {
+	for _, v := range values {
+		if name, ok := requiredName(v); ok {
+			return []anchor{{name, nil}}, true
+		}
+	}
+	return nil, false
+}
+
+// Find an attribute whose absence makes a value bottom
+func requiredName(node *elvin.AST) (string, bool) {
+	switch node.TypeCode {
+	case elvin.NameTypeCode:
+		return node.Value.(string), true
+
+	case elvin.UnaryPlusTypeCode, elvin.UnaryMinusTypeCode, elvin.BinaryNotTypeCode,
+		elvin.FuncFoldCaseTypeCode, elvin.FuncDecomposeTypeCode, elvin.FuncDecomposeCompatTypeCode,
+		elvin.FuncSizeTypeCode:
+		return requiredName(node.Children[0])
+
+	case elvin.MultiplyTypeCode, elvin.DivideTypeCode, elvin.ModuloTypeCode,
+		elvin.AddTypeCode, elvin.SubtractTypeCode,
+		elvin.ShiftLeftTypeCode, elvin.ShiftRightTypeCode, elvin.LogicalShiftRightTypeCode,
+		elvin.BinaryAndTypeCode, elvin.BinaryExclusiveOrTypeCode, elvin.BinaryOrTypeCode:
+		for _, child := range node.Children {
+			if name, ok := requiredName(child); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func anchorsCost(anchors []anchor) (cost int) {
+	for _, a := range anchors {
+		if a.value == nil {
+			cost += nameAnchorCost
+		} else {
+			cost++
+		}
+	}
+	return cost
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+)
+
+var matcherExprs = []string{
+	"Group == 3",
+	"Group == 3.0 && Level > 2",
+	"Group == 4 || Name == \"foo\"",
+	"require(Level) && !require(Group)",
+	"!require(Group)",
+	"Level - 1 < 2",
+	"equals(Name, \"foo\", \"bar\")",
+	"begins-with(fold-case(Name), \"fo\")",
+	"Data == Name",
+	"Group == 3L ^^ Level == 1",
+	"!(Level == 5)",
+}
+
+var matcherNotifications = []map[string]interface{}{
+	{},
+	{"Group": int32(3)},
+	{"Group": int64(3), "Level": int32(3)},
+	{"Group": float64(4), "Level": int32(1)},
+	{"Level": int32(2)},
+	{"Name": "foo"},
+	{"Name": "FOO", "Data": []byte("foo")},
+	{"Name": "bar", "Group": "3"},
+}
+
+// Create an indexed subscription for each expression
+func matcherSubs(t testing.TB, exprs []string) (*Matcher, []*Subscription) {
+	var m Matcher
+	m.Init()
+	var subs []*Subscription
+	for i, expr := range exprs {
+		ast, nack := Parse(expr, elvin.DefaultExpressionLimits)
+		if nack != nil {
+			t.Fatalf("Parse(%s) failed: %v", expr, nack)
+		}
+		sub := &Subscription{SubID: int64(i), AcceptInsecure: true, Ast: ast, Predicate: ast.Compile()}
+		m.Add(sub)
+		subs = append(subs, sub)
+	}
+	return &m, subs
+}
+
+// The IDs of subscriptions matching a notification
+func matching(subs []*Subscription, nv map[string]interface{}) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, sub := range subs {
+		if sub.Predicate(nv) == elvin.LukTrue {
+			ids[sub.SubID] = true
+		}
+	}
+	return ids
+}
+
+// The matcher's candidates must never miss a match
+func TestMatcher(t *testing.T) {
+	m, subs := matcherSubs(t, matcherExprs)
+
+	for _, nv := range matcherNotifications {
+		candidates := m.Candidates(nv)
+		seen := make(map[int64]bool)
+		for _, sub := range candidates {
+			if seen[sub.SubID] {
+				t.Errorf("%v: duplicate candidate %s", nv, matcherExprs[sub.SubID])
+			}
+			seen[sub.SubID] = true
+		}
+
+		expected := matching(subs, nv)
+		got := matching(candidates, nv)
+		for id := range expected {
+			if !got[id] {
+				t.Errorf("%v: missed %s", nv, matcherExprs[id])
+			}
+		}
+		if len(got) != len(expected) {
+			t.Errorf("%v: got %v expected %v", nv, got, expected)
+		}
+	}
+
+	// Equality anchors should rule out other values
+	if candidates := m.Candidates(map[string]interface{}{"Group": int32(5)}); len(candidates) != 3 {
+		t.Errorf("Group == 5: expected the 3 unanchored candidates, got %d", len(candidates))
+	}
+
+	// Modify and delete must leave nothing behind
+	ast, _ := Parse("Other == 1", elvin.DefaultExpressionLimits)
+	subs[0] = &Subscription{SubID: subs[0].SubID, AcceptInsecure: true, Ast: ast, Predicate: ast.Compile()}
+	m.Modify(subs[0])
+	for _, sub := range m.Candidates(map[string]interface{}{"Group": int32(3)}) {
+		if sub.SubID == subs[0].SubID {
+			t.Errorf("Modified subscription still anchored on Group")
+		}
+	}
+	if candidates := m.Candidates(map[string]interface{}{"Other": int32(1)}); len(candidates) != 4 || candidates[3] != subs[0] {
+		t.Errorf("Modified subscription not anchored on Other")
+	}
+	for _, sub := range subs {
+		m.Delete(sub)
+	}
+	if m.Len() != 0 || len(m.index) != 0 || len(m.always) != 0 {
+		t.Errorf("Delete left %d subscriptions, %d anchors", m.Len(), len(m.index))
+	}
+}
+
+// A realistic(ish) population of subscriptions, most of which
+// select on an equality
+func benchmarkSubs(b *testing.B, count int) (*Matcher, []*Subscription) {
+	exprs := make([]string, count)
+	for i := range exprs {
+		switch i % 4 {
+		case 0, 1:
+			exprs[i] = fmt.Sprintf("Group == %d && Level > %d", i, i%10)
+		case 2:
+			exprs[i] = fmt.Sprintf("Service == \"svc%d\" || Host == \"host%d\"", i, i)
+		case 3:
+			exprs[i] = fmt.Sprintf("require(Attr%d) && size(Message) > %d", i%100, i%50)
+		}
+	}
+	return matcherSubs(b, exprs)
+}
+
+var benchmarkNotification = map[string]interface{}{
+	"Group":   int32(42),
+	"Level":   int32(5),
+	"Host":    "host66",
+	"Attr7":   int32(1),
+	"Message": "hello world",
+}
+
+func benchmarkNaive(b *testing.B, count int) {
+	_, subs := benchmarkSubs(b, count)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matching(subs, benchmarkNotification)
+	}
+}
+
+func benchmarkIndexed(b *testing.B, count int) {
+	m, _ := benchmarkSubs(b, count)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matching(m.Candidates(benchmarkNotification), benchmarkNotification)
+	}
+}
+
+func BenchmarkMatchNaive1000(b *testing.B)     { benchmarkNaive(b, 1000) }
+func BenchmarkMatchIndexed1000(b *testing.B)   { benchmarkIndexed(b, 1000) }
+func BenchmarkMatchNaive10000(b *testing.B)    { benchmarkNaive(b, 10000) }
+func BenchmarkMatchIndexed10000(b *testing.B)  { benchmarkIndexed(b, 10000) }
+func BenchmarkMatchNaive100000(b *testing.B)   { benchmarkNaive(b, 100000) }
+func BenchmarkMatchIndexed100000(b *testing.B) { benchmarkIndexed(b, 100000) }
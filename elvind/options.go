@@ -0,0 +1,136 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+)
+
+// A connection option the router supports. Integer options may be
+// requested anywhere within [min, max] and are clamped to any limit
+// the router is configured with, while string options must be one of
+// values.
+type connectionOption struct {
+	min    int32
+	max    int32
+	values []string
+	def    interface{} // When not requested
+}
+
+const (
+	kilobyte = 1024
+	megabyte = 1024 * kilobyte
+)
+
+// The standard connection options
+var connectionOptions = map[string]connectionOption{
+	"Packet.Max-Length":         {min: kilobyte, max: 10 * megabyte, def: int32(megabyte)},
+	"Subscription.Max-Count":    {min: 16, max: 2048, def: int32(2048)},
+	"Subscription.Max-Length":   {min: kilobyte, max: 4 * kilobyte, def: int32(2 * kilobyte)},
+	"Attribute.Max-Count":       {min: 16, max: 2048, def: int32(256)},
+	"Receive-Queue.Max-Length":  {min: kilobyte, max: 10 * megabyte, def: int32(DefaultReceiveQueueLength)},
+	"Receive-Queue.Drop-Policy": {values: []string{"oldest", "newest", "largest", "fail"}, def: "oldest"},
+	"Send-Queue.Max-Length":     {min: kilobyte, max: 10 * megabyte, def: int32(megabyte)},
+	"Send-Queue.Drop-Policy":    {values: []string{"oldest", "newest", "largest", "fail"}, def: "oldest"},
+	// Packets are written as a header and a body so delaying
+	// small writes costs a round trip
+	"TCP.Send-Immediately": {min: 0, max: 1, def: int32(1)},
+}
+
+// Negotiate a client's connection options, returning the value of
+// every supported option: those requested, clamped to the router's
+// limits, and otherwise the defaults. A request for an unknown option
+// or for a value out of the option's range is Nacked.
+func negotiateOptions(requested map[string]interface{}, limits map[string]int) (accepted map[string]interface{}, nack *elvin.Nack) {
+	accepted = make(map[string]interface{})
+	for name, option := range connectionOptions {
+		accepted[name] = option.def
+	}
+
+	for name, v := range requested {
+		option, ok := connectionOptions[name]
+		if !ok {
+			return nil, optionNack(name)
+		}
+
+		if option.values != nil {
+			s, ok := v.(string)
+			if !ok || !contains(option.values, s) {
+				return nil, optionNack(name)
+			}
+			accepted[name] = s
+			continue
+		}
+
+		var i int64
+		switch v := v.(type) {
+		case int32:
+			i = int64(v)
+		case int64:
+			i = v
+		default:
+			return nil, optionNack(name)
+		}
+		if i < int64(option.min) || i > int64(option.max) {
+			return nil, optionNack(name)
+		}
+		accepted[name] = int32(i)
+	}
+
+	// Clamp to the router's limits, which are never below an
+	// option's minimum
+	for name, limit := range limits {
+		option, ok := connectionOptions[name]
+		if !ok || option.values != nil {
+			continue
+		}
+		if int64(limit) < int64(option.min) {
+			limit = int(option.min)
+		}
+		if int64(accepted[name].(int32)) > int64(limit) {
+			accepted[name] = int32(limit)
+		}
+	}
+	return accepted, nil
+}
+
+// The value of one of a client's integer connection options
+func (client *Client) limit(name string) int {
+	return int(client.options[name].(int32))
+}
+
+// A Nack for a connection option that can't be accepted
+func optionNack(name string) *elvin.Nack {
+	nack := new(elvin.Nack)
+	nack.ErrorCode = elvin.ErrorsQOSLimit
+	nack.Message = elvin.ProtocolErrors[nack.ErrorCode].Message
+	nack.Args = []interface{}{name}
+	return nack
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
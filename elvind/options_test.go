@@ -0,0 +1,128 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+)
+
+func TestNegotiateOptions(t *testing.T) {
+	limits := map[string]int{
+		"Subscription.Max-Count": 100,
+		"Attribute.Max-Count":    1, // Below the minimum
+		"Unknown.Option":         5, // Ignored
+	}
+
+	tests := []struct {
+		requested map[string]interface{}
+		expected  map[string]interface{}
+	}{
+		{nil, map[string]interface{}{
+			"Subscription.Max-Count":    int32(100),
+			"Attribute.Max-Count":       int32(16),
+			"Packet.Max-Length":         int32(megabyte),
+			"Receive-Queue.Drop-Policy": "oldest",
+		}},
+		{map[string]interface{}{
+			"Subscription.Max-Count":    int32(50),
+			"Packet.Max-Length":         int64(2 * megabyte),
+			"Receive-Queue.Max-Length":  int32(kilobyte),
+			"Receive-Queue.Drop-Policy": "largest",
+			"TCP.Send-Immediately":      int32(0),
+		}, map[string]interface{}{
+			"Subscription.Max-Count":    int32(50),
+			"Packet.Max-Length":         int32(2 * megabyte),
+			"Receive-Queue.Max-Length":  int32(kilobyte),
+			"Receive-Queue.Drop-Policy": "largest",
+			"TCP.Send-Immediately":      int32(0),
+		}},
+		{map[string]interface{}{"Subscription.Max-Count": int32(2048)}, map[string]interface{}{
+			"Subscription.Max-Count": int32(100),
+		}},
+	}
+
+	for _, test := range tests {
+		accepted, nack := negotiateOptions(test.requested, limits)
+		if nack != nil {
+			t.Errorf("negotiateOptions(%v) Nacked: %v", test.requested, nack)
+			continue
+		}
+		if len(accepted) != len(connectionOptions) {
+			t.Errorf("negotiateOptions(%v) accepted %v", test.requested, accepted)
+		}
+		for name, v := range test.expected {
+			if accepted[name] != v {
+				t.Errorf("negotiateOptions(%v) gave %s = %v, expected %v", test.requested, name, accepted[name], v)
+			}
+		}
+	}
+}
+
+func TestNegotiateOptionsNack(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"Unknown.Option": int32(1)},
+		{"Subscription.Max-Count": int32(1)},
+		{"Packet.Max-Length": int64(1 << 40)},
+		{"Packet.Max-Length": "big"},
+		{"Receive-Queue.Drop-Policy": "random"},
+		{"Receive-Queue.Drop-Policy": int32(1)},
+		{"TCP.Send-Immediately": int32(2)},
+	}
+
+	for _, requested := range tests {
+		_, nack := negotiateOptions(requested, nil)
+		if nack == nil || nack.ErrorCode != elvin.ErrorsQOSLimit {
+			t.Errorf("negotiateOptions(%v) gave %v", requested, nack)
+		}
+	}
+}
+
+func TestConnectOptions(t *testing.T) {
+	c := elvin.NewClient(testURL, map[string]interface{}{"Subscription.Max-Count": int32(64)}, nil, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	options := c.ConnectionOptions()
+	if options["Subscription.Max-Count"] != int32(64) || options["Receive-Queue.Drop-Policy"] != "oldest" {
+		t.Errorf("Negotiated %v", options)
+	}
+	if err := c.Disconnect(); err != nil {
+		t.Errorf("Disconnect failed: %v", err)
+	}
+
+	c = elvin.NewClient(testURL, map[string]interface{}{"No.Such-Option": int32(1)}, nil, nil)
+	if err := c.Connect(); err == nil {
+		t.Errorf("Connect with an unknown option succeeded")
+	}
+	if c.ConnectionOptions() != nil {
+		t.Errorf("Failed connection has options %v", c.ConnectionOptions())
+	}
+
+	// The refused connection is closed so the client can try again
+	c.Options = nil
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect after a refusal failed: %v", err)
+	}
+	if err := c.Disconnect(); err != nil {
+		t.Errorf("Disconnect failed: %v", err)
+	}
+}
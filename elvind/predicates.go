@@ -0,0 +1,200 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"sync"
+	"sync/atomic"
+)
+
+// Predicates holds the compiled form of every subscription, sharing
+// identical sub-expressions between them. For example:
+//
+//	TYPE == "alarm" && Level > 3
+//	TYPE == "alarm" && Host == "db1"
+//
+// share a single TYPE == "alarm" predicate. Sub-expressions are keyed
+// on their canonical form and each remembers its result for the
+// notification being evaluated, so it is evaluated at most once per
+// notification no matter how many subscriptions contain it.
+//
+// Subscriptions are added by the Subscriptions goroutine while the
+// Notify goroutine is the only one to evaluate them, calling Begin()
+// before each notification. A subscription's Predicate is set before
+// the matcher can return it and never changed after, so a modified
+// subscription must be a new one with the same SubID.
+type Predicates struct {
+	mu     sync.Mutex
+	shared map[string]*sharedPredicate // By canonical form
+	roots  map[int64]*sharedPredicate  // Each subscription's expression, by SubID
+	nodes  int                         // Predicates in all subscriptions before sharing
+
+	// Owned by the Notify goroutine
+	generation uint64 // Of the current notification
+	evaluated  uint64 // Predicates evaluated
+	reused     uint64 // Results reused
+	published  [2]uint64
+}
+
+// A predicate used by one or more subscriptions or other predicates
+type sharedPredicate struct {
+	key       string
+	refs      int
+	size      int                // Predicates in the expression, including this one
+	children  []*sharedPredicate // Shared operands, released with this
+	predicate elvin.Predicate    // The compiled expression
+	memo      elvin.Predicate    // Returns the result for the current notification
+
+	generation uint64 // Of the notification with the result
+	result     int
+}
+
+// Statistics showing how much sharing there is
+type PredicateStats struct {
+	Subscriptions int    // Subscriptions compiled
+	Predicates    int    // Predicates in those subscriptions
+	Distinct      int    // Predicates once shared
+	Evaluated     uint64 // Predicates evaluated over all notifications
+	Reused        uint64 // Evaluations saved by sharing
+}
+
+// Initialize an empty set of predicates
+func (predicates *Predicates) Init() {
+	predicates.shared = make(map[string]*sharedPredicate)
+	predicates.roots = make(map[int64]*sharedPredicate)
+}
+
+// Compile a new subscription's expression setting its Predicate
+func (predicates *Predicates) Add(sub *Subscription) {
+	predicates.mu.Lock()
+	defer predicates.mu.Unlock()
+	predicates.compile(sub)
+}
+
+// Compile a subscription replacing the one with the same SubID
+func (predicates *Predicates) Modify(sub *Subscription) {
+	predicates.mu.Lock()
+	defer predicates.mu.Unlock()
+
+	// Compile first so anything in common is kept
+	old := predicates.roots[sub.SubID]
+	predicates.compile(sub)
+	if old != nil {
+		predicates.nodes -= old.size
+		predicates.release(old)
+	}
+}
+
+// Remove a subscription's predicates. The subscription keeps its
+// Predicate as the Notify goroutine may be evaluating it, but it will
+// no longer be shared by others.
+func (predicates *Predicates) Delete(sub *Subscription) {
+	predicates.mu.Lock()
+	defer predicates.mu.Unlock()
+	if root, ok := predicates.roots[sub.SubID]; ok {
+		delete(predicates.roots, sub.SubID)
+		predicates.nodes -= root.size
+		predicates.release(root)
+	}
+}
+
+// Start evaluating a new notification, forgetting previous results
+func (predicates *Predicates) Begin() {
+	atomic.StoreUint64(&predicates.published[0], predicates.evaluated)
+	atomic.StoreUint64(&predicates.published[1], predicates.reused)
+	predicates.generation++
+}
+
+// Current statistics. Evaluation counts are as of the last Begin()
+func (predicates *Predicates) Stats() PredicateStats {
+	predicates.mu.Lock()
+	defer predicates.mu.Unlock()
+	return PredicateStats{
+		Subscriptions: len(predicates.roots),
+		Predicates:    predicates.nodes,
+		Distinct:      len(predicates.shared),
+		Evaluated:     atomic.LoadUint64(&predicates.published[0]),
+		Reused:        atomic.LoadUint64(&predicates.published[1]),
+	}
+}
+
+// Compile a subscription's expression, interning its predicates
+func (predicates *Predicates) compile(sub *Subscription) {
+	if sub.Ast == nil {
+		delete(predicates.roots, sub.SubID)
+		return
+	}
+
+	// Each predicate is held by the one it was compiled for,
+	// or the subscription itself at the root
+	var owner, root *sharedPredicate
+	sub.Predicate = sub.Ast.CompileShared(func(node *elvin.AST, compile func() elvin.Predicate) elvin.Predicate {
+		key := elvin.Format(node)
+		p, ok := predicates.shared[key]
+		if !ok {
+			p = &sharedPredicate{key: key, size: 1}
+			predicates.shared[key] = p
+			parent := owner
+			owner = p
+			p.predicate = compile()
+			owner = parent
+			p.memo = predicates.memoise(p)
+		}
+
+		p.refs++
+		if owner == nil {
+			root = p
+		} else {
+			owner.children = append(owner.children, p)
+			owner.size += p.size
+		}
+		return p.memo
+	})
+	predicates.roots[sub.SubID] = root
+	predicates.nodes += root.size
+}
+
+// Drop a reference to a predicate, and its operands once unused
+func (predicates *Predicates) release(p *sharedPredicate) {
+	p.refs--
+	if p.refs > 0 {
+		return
+	}
+	delete(predicates.shared, p.key)
+	for _, child := range p.children {
+		predicates.release(child)
+	}
+}
+
+// Evaluate a predicate once per notification
+func (predicates *Predicates) memoise(p *sharedPredicate) elvin.Predicate {
+	return func(n map[string]interface{}) int {
+		if p.generation == predicates.generation {
+			predicates.reused++
+			return p.result
+		}
+		p.result = p.predicate(n)
+		p.generation = predicates.generation
+		predicates.evaluated++
+		return p.result
+	}
+}
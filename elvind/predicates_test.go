@@ -0,0 +1,148 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+)
+
+func predicateSub(t *testing.T, id int64, expr string) *Subscription {
+	t.Helper()
+	ast, nack := Parse(expr, elvin.DefaultExpressionLimits)
+	if nack != nil {
+		t.Fatalf("Parse(%s) failed: %v", expr, nack)
+	}
+	return &Subscription{SubID: id, AcceptInsecure: true, Ast: ast}
+}
+
+// Evaluate every subscription for a notification as Notify() does
+func evaluatePredicates(t *testing.T, predicates *Predicates, subs []*Subscription, nfn map[string]interface{}) {
+	t.Helper()
+	predicates.Begin()
+	for _, sub := range subs {
+		if result, expected := sub.Predicate(nfn), sub.Ast.Eval(nfn); result != expected {
+			t.Errorf("Subscription %d (%s) evaluated to %d, expected %d", sub.SubID, sub.Ast, result, expected)
+		}
+	}
+}
+
+func checkStats(t *testing.T, predicates *Predicates, subscriptions, nodes, distinct int) {
+	t.Helper()
+	stats := predicates.Stats()
+	if stats.Subscriptions != subscriptions || stats.Predicates != nodes || stats.Distinct != distinct {
+		t.Errorf("Expected %d subscriptions, %d predicates, %d distinct: got %+v", subscriptions, nodes, distinct, stats)
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	var predicates Predicates
+	predicates.Init()
+
+	subs := []*Subscription{
+		predicateSub(t, 1, "TYPE == 'alarm' && Level > 3"),
+		predicateSub(t, 2, "TYPE == 'alarm' && Host == 'db1'"),
+		predicateSub(t, 3, "TYPE == \"alarm\" && (Level > 3)"),
+		predicateSub(t, 4, "Level > 3 || Host == 'db1'"),
+	}
+	for _, sub := range subs {
+		predicates.Add(sub)
+	}
+
+	// TYPE == "alarm", Level > 3, Host == "db1", the two
+	// conjunctions and the disjunction
+	checkStats(t, &predicates, 4, 12, 6)
+
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"TYPE": "alarm", "Level": int32(5), "Host": "db1"})
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"TYPE": "other", "Level": int32(1)})
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"Host": "db1"})
+
+	// The first notification evaluated each predicate once,
+	// and reused TYPE == "alarm", the first conjunction and
+	// Level > 3
+	predicates.Begin()
+	stats := predicates.Stats()
+	if stats.Evaluated == 0 || stats.Reused == 0 {
+		t.Errorf("Nothing shared: %+v", stats)
+	}
+
+	// Modifying keeps what's still used
+	old := subs[0]
+	subs[0] = predicateSub(t, 1, "Host == 'db1'")
+	predicates.Modify(subs[0])
+	checkStats(t, &predicates, 4, 10, 6)
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"TYPE": "alarm", "Host": "db2"})
+
+	// Conjunctions release their operands
+	predicates.Delete(subs[1])
+	checkStats(t, &predicates, 3, 7, 5)
+	predicates.Delete(subs[2])
+	checkStats(t, &predicates, 2, 4, 3)
+	predicates.Delete(subs[0])
+	predicates.Delete(subs[3])
+	checkStats(t, &predicates, 0, 0, 0)
+
+	// Replaced and deleted subscriptions may still be being
+	// evaluated so keep working
+	evaluatePredicates(t, &predicates, []*Subscription{old, subs[1]}, map[string]interface{}{"TYPE": "alarm", "Level": int32(5)})
+}
+
+func TestPredicatesCounts(t *testing.T) {
+	var predicates Predicates
+	predicates.Init()
+
+	subs := []*Subscription{
+		predicateSub(t, 1, "TYPE == 'alarm' && Level > 3"),
+		predicateSub(t, 2, "TYPE == 'alarm' && Host == 'db1'"),
+		predicateSub(t, 3, "TYPE == 'alarm' && Level > 3"),
+		predicateSub(t, 4, "Level > 3 || Host == 'db1'"),
+	}
+	for _, sub := range subs {
+		predicates.Add(sub)
+	}
+
+	// The first conjunction, its operands, the second and
+	// Host == "db1" and then the disjunction are evaluated. The
+	// second conjunction reuses TYPE == "alarm", the third
+	// subscription the first conjunction and the disjunction
+	// Level > 3.
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"TYPE": "alarm", "Level": int32(5), "Host": "db1"})
+	predicates.Begin()
+	if stats := predicates.Stats(); stats.Evaluated != 6 || stats.Reused != 3 {
+		t.Errorf("Expected 6 evaluated and 3 reused: got %+v", stats)
+	}
+}
+
+func TestPredicatesFoldedReals(t *testing.T) {
+	var predicates Predicates
+	predicates.Init()
+
+	// An infinity folded from a division isn't the attribute Inf
+	subs := []*Subscription{
+		predicateSub(t, 1, "x < 1.0 / 0.0"),
+		predicateSub(t, 2, "x < +Inf"),
+	}
+	for _, sub := range subs {
+		predicates.Add(sub)
+	}
+	checkStats(t, &predicates, 2, 2, 2)
+	evaluatePredicates(t, &predicates, subs, map[string]interface{}{"x": 5.0, "Inf": 1.0})
+}
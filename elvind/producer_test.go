@@ -0,0 +1,89 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+// Wait for a producer's view of the subscription terms to settle
+func waitForTerms(t *testing.T, producer *elvin.Producer, terms int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if producer.Terms() == terms {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d terms, have %d", terms, producer.Terms())
+}
+
+func TestProducer(t *testing.T) {
+	producer, err := elvin.NewProducer(client, map[string]bool{"Sensor": true, "Reading": true}, true, nil)
+	if err != nil {
+		t.Fatalf("NewProducer failed %v", err)
+	}
+
+	// No-one is listening so nothing is sent
+	nfn := map[string]interface{}{"Sensor": "temp", "Reading": int32(25)}
+	if sent, err := producer.Notify(nfn, true, nil); sent || err != nil {
+		t.Fatalf("Notify with no subscribers sent:%v err:%v", sent, err)
+	}
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "Sensor == \"temp\" && Reading > 30"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{}, 1)
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	waitForTerms(t, producer, 1)
+
+	// Still not interesting
+	if producer.Interested(nfn) {
+		t.Fatalf("Producer interested in %v", nfn)
+	}
+
+	// But this is
+	nfn["Reading"] = int32(35)
+	if sent, err := producer.Notify(nfn, true, nil); !sent || err != nil {
+		t.Fatalf("Notify with a subscriber sent:%v err:%v", sent, err)
+	}
+	select {
+	case <-sub.Notifications:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed %v", err)
+	}
+	waitForTerms(t, producer, 0)
+	if producer.Interested(nfn) {
+		t.Fatalf("Producer interested after unsubscribe")
+	}
+
+	if err := producer.Close(); err != nil {
+		t.Fatalf("Close failed %v", err)
+	}
+}
@@ -21,7 +21,9 @@
 package main
 
 import (
+	"bytes"
 	"github.com/cobaro/elvin/elvin"
+	"sync"
 )
 
 // A quench
@@ -31,3 +33,445 @@ type Quench struct {
 	Keys            elvin.KeyBlock
 	Names           map[string]bool // easy insert/delete, values irrelevant
 }
+
+// A term of a subscription as seen by quenching clients. Terms are the
+// disjuncts of a subscription's expression, any one of which may cause
+// it to match.
+type term struct {
+	id       uint64
+	sub      *Subscription
+	ast      *elvin.AST
+	names    map[string]bool // Attribute names referenced
+	quenches map[int64]bool  // QuenchIDs told about this term, mapped to whether securely
+}
+
+// The Quencher tracks the terms of every subscription and tells
+// quenching clients, via SubAddNotify, SubModNotify and SubDelNotify,
+// about those that reference the attribute names they've quenched. It
+// is driven by the Subscriptions and Quenches goroutines. Subscriptions
+// and quenches are kept by their IDs, as one that's modified is
+// replaced by a new one rather than changed.
+type Quencher struct {
+	mu       sync.Mutex
+	router   *Router
+	quenches map[int64]*Quench         // By QuenchID
+	terms    map[int64][]*term         // By SubID
+	byName   map[string]map[*term]bool // Terms referencing each name
+	told     map[int64]map[*term]bool  // By QuenchID
+	termID   uint64
+}
+
+// Quencher initialization
+func (q *Quencher) Init(router *Router) {
+	q.router = router
+	q.quenches = make(map[int64]*Quench)
+	q.terms = make(map[int64][]*term)
+	q.byName = make(map[string]map[*term]bool)
+	q.told = make(map[int64]map[*term]bool)
+}
+
+// A subscription was added so tell interested quenches its terms
+func (q *Quencher) SubAdd(sub *Subscription) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, ast := range splitTerms(sub.Ast) {
+		t := q.newTerm(sub, ast)
+		q.sendAdd(t, q.interested(t))
+	}
+}
+
+// A subscription was modified, replacing the one with the same SubID.
+// Its new terms are paired with the old ones so that each keeps its
+// TermID: identical terms first, then those referencing a common name,
+// then any left over.
+func (q *Quencher) SubMod(sub *Subscription) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	old := q.terms[sub.SubID]
+	delete(q.terms, sub.SubID)
+	asts := splitTerms(sub.Ast)
+
+	paired := make([]*term, len(asts))
+	used := make(map[*term]bool)
+	pair := func(match func(t *term, ast *elvin.AST) bool) {
+		for i, ast := range asts {
+			if paired[i] != nil {
+				continue
+			}
+			for _, t := range old {
+				if !used[t] && match(t, ast) {
+					paired[i] = t
+					used[t] = true
+					break
+				}
+			}
+		}
+	}
+	pair(func(t *term, ast *elvin.AST) bool {
+		return termKey(t.ast) == termKey(ast)
+	})
+	pair(func(t *term, ast *elvin.AST) bool {
+		for name := range termNames(ast, nil) {
+			if t.names[name] {
+				return true
+			}
+		}
+		return false
+	})
+	pair(func(t *term, ast *elvin.AST) bool {
+		return true
+	})
+
+	for i, ast := range asts {
+		t := paired[i]
+		if t == nil {
+			t = q.newTerm(sub, ast)
+			q.sendAdd(t, q.interested(t))
+			continue
+		}
+
+		changed := termKey(t.ast) != termKey(ast)
+		q.unindex(t)
+		t.sub = sub
+		t.ast = ast
+		t.names = termNames(ast, nil)
+		q.index(t)
+		q.terms[sub.SubID] = append(q.terms[sub.SubID], t)
+
+		// The subscription's security may also have changed
+		added, modified := make(map[int64]bool), make(map[int64]bool)
+		interested := q.interested(t)
+		for id, secure := range interested {
+			if told, ok := t.quenches[id]; !ok {
+				added[id] = secure
+			} else if changed || told != secure {
+				modified[id] = secure
+			}
+		}
+		removed := make(map[int64]bool)
+		for id := range t.quenches {
+			if _, ok := interested[id]; !ok {
+				removed[id] = true
+			}
+		}
+		q.sendDel(t, removed)
+		q.sendMod(t, modified)
+		q.sendAdd(t, added)
+	}
+
+	// Any left over have gone
+	for _, t := range old {
+		if !used[t] {
+			q.deleteTerm(t)
+		}
+	}
+}
+
+// A subscription was deleted so its terms are gone
+func (q *Quencher) SubDel(sub *Subscription) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, t := range q.terms[sub.SubID] {
+		q.deleteTerm(t)
+	}
+	delete(q.terms, sub.SubID)
+}
+
+// A quench was added so tell it about the terms it's interested in
+func (q *Quencher) QuenchAdd(quench *Quench) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.quenches[quench.QuenchID] = quench
+	q.told[quench.QuenchID] = make(map[*term]bool)
+	q.update(quench, nil)
+}
+
+// A quench's names, keys or delivery were modified, replacing the one
+// with the same QuenchID, so tell it about terms it's now interested
+// in and those it no longer is
+func (q *Quencher) QuenchMod(quench *Quench) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.quenches[quench.QuenchID]; !ok {
+		return
+	}
+	q.quenches[quench.QuenchID] = quench
+	previous := make(map[*term]bool)
+	for t := range q.told[quench.QuenchID] {
+		previous[t] = true
+	}
+	q.update(quench, previous)
+}
+
+// A quench was deleted so it's no longer told anything
+func (q *Quencher) QuenchDel(quench *Quench) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for t := range q.told[quench.QuenchID] {
+		delete(t.quenches, quench.QuenchID)
+	}
+	delete(q.told, quench.QuenchID)
+	delete(q.quenches, quench.QuenchID)
+}
+
+// A client's connection keys were modified so bring its quenches up
+// to date and every quench with its subscriptions' terms
+func (q *Quencher) KeysMod(id int32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for quenchID, quench := range q.quenches {
+		previous := make(map[*term]bool)
+		for t := range q.told[quenchID] {
+			previous[t] = true
+		}
+		if int32(quenchID>>32) == id {
+			q.update(quench, previous)
+			continue
+		}
+		for subID, terms := range q.terms {
+			if int32(subID>>32) != id {
+				continue
+			}
+			for _, t := range terms {
+				q.check(t, quench, previous[t])
+			}
+		}
+	}
+}
+
+// Bring a quench up to date with the terms referencing its names,
+// given those it has previously been told about
+func (q *Quencher) update(quench *Quench, previous map[*term]bool) {
+	candidates := make(map[*term]bool)
+	for t := range previous {
+		candidates[t] = true
+	}
+	for name := range quench.Names {
+		for t := range q.byName[name] {
+			candidates[t] = true
+		}
+	}
+
+	for t := range candidates {
+		q.check(t, quench, previous[t])
+	}
+}
+
+// Tell a quench about a term it's now allowed, a change to whether
+// that's secure, or that it no longer is, given whether it's
+// previously been told
+func (q *Quencher) check(t *term, quench *Quench, previous bool) {
+	secure, allowed := q.allowed(t, quench)
+	target := map[int64]bool{quench.QuenchID: secure}
+	switch {
+	case allowed && !previous:
+		q.sendAdd(t, target)
+	case allowed && previous && t.quenches[quench.QuenchID] != secure:
+		q.sendMod(t, target)
+	case !allowed && previous:
+		q.sendDel(t, target)
+	}
+}
+
+// Create and index a new term
+func (q *Quencher) newTerm(sub *Subscription, ast *elvin.AST) *term {
+	q.termID++
+	t := &term{q.termID, sub, ast, termNames(ast, nil), make(map[int64]bool)}
+	q.terms[sub.SubID] = append(q.terms[sub.SubID], t)
+	q.index(t)
+	return t
+}
+
+// Tell everyone a term has gone and forget it
+func (q *Quencher) deleteTerm(t *term) {
+	q.sendDel(t, t.quenches)
+	q.unindex(t)
+}
+
+func (q *Quencher) index(t *term) {
+	for name := range t.names {
+		terms, ok := q.byName[name]
+		if !ok {
+			terms = make(map[*term]bool)
+			q.byName[name] = terms
+		}
+		terms[t] = true
+	}
+}
+
+func (q *Quencher) unindex(t *term) {
+	for name := range t.names {
+		delete(q.byName[name], t)
+		if len(q.byName[name]) == 0 {
+			delete(q.byName, name)
+		}
+	}
+}
+
+// The QuenchIDs of the quenches that should be told about a term,
+// mapped to whether that is secure
+func (q *Quencher) interested(t *term) map[int64]bool {
+	targets := make(map[int64]bool)
+	for id, quench := range q.quenches {
+		if secure, ok := q.allowed(t, quench); ok {
+			targets[id] = secure
+		}
+	}
+	return targets
+}
+
+// Whether a quench should be told about a term and if so whether it's
+// secure. The quencher is treated as a producer whose keys must match
+// the subscriber's, otherwise both must allow insecure delivery.
+func (q *Quencher) allowed(t *term, quench *Quench) (secure bool, ok bool) {
+	referenced := false
+	for name := range quench.Names {
+		if t.names[name] {
+			referenced = true
+			break
+		}
+	}
+	if !referenced {
+		return false, false
+	}
+
+	quencher := q.router.client(int32(quench.QuenchID >> 32))
+	subscriber := q.router.client(int32(t.sub.SubID >> 32))
+	if quencher == nil || subscriber == nil {
+		return false, false
+	}
+
+	keysNfn, _ := quencher.connectionKeys()
+	_, keysSub := subscriber.connectionKeys()
+	nfn := Notification{keysNfn, nil, quench.DeliverInsecure, quench.Keys}
+	if KeysMatch(nfn, *t.sub, keysNfn, keysSub) {
+		return true, true
+	}
+	return false, quench.DeliverInsecure && t.sub.AcceptInsecure
+}
+
+// Send a SubAddNotify to each quenching client and record that
+// they've been told
+func (q *Quencher) sendAdd(t *term, targets map[int64]bool) {
+	for id, ids := range groupQuenches(targets) {
+		pkt := &elvin.SubAddNotify{
+			SecureQuenchIDs:   ids.secure,
+			InsecureQuenchIDs: ids.insecure,
+			TermID:            t.id,
+			SubExpr:           t.ast,
+		}
+		q.send(id, pkt)
+	}
+	for id, secure := range targets {
+		t.quenches[id] = secure
+		q.told[id][t] = true
+	}
+}
+
+// Send a SubModNotify to each quenching client and record whether
+// they've now been told securely
+func (q *Quencher) sendMod(t *term, targets map[int64]bool) {
+	for id, ids := range groupQuenches(targets) {
+		pkt := &elvin.SubModNotify{
+			SecureQuenchIDs:   ids.secure,
+			InsecureQuenchIDs: ids.insecure,
+			TermID:            t.id,
+			SubExpr:           t.ast,
+		}
+		q.send(id, pkt)
+	}
+	for id, secure := range targets {
+		t.quenches[id] = secure
+	}
+}
+
+// Send a SubDelNotify to each quenching client and record that
+// they've been told
+func (q *Quencher) sendDel(t *term, targets map[int64]bool) {
+	for id, ids := range groupQuenches(targets) {
+		pkt := &elvin.SubDelNotify{
+			QuenchIDs: append(ids.secure, ids.insecure...),
+			TermID:    t.id,
+		}
+		q.send(id, pkt)
+	}
+	for id := range targets {
+		delete(t.quenches, id)
+		delete(q.told[id], t)
+	}
+}
+
+// Encode a packet for a client's write handler
+func (q *Quencher) send(id int32, pkt interface {
+	Encode(*bytes.Buffer)
+}) {
+	client := q.router.client(id)
+	if client == nil {
+		return
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	pkt.Encode(buf)
+	client.deliver(buf)
+}
+
+// Quench IDs for one client
+type quenchIDs struct {
+	secure   []int64
+	insecure []int64
+}
+
+// Group QuenchIDs by their client
+func groupQuenches(targets map[int64]bool) map[int32]*quenchIDs {
+	groups := make(map[int32]*quenchIDs)
+	for quenchID, secure := range targets {
+		id := int32(quenchID >> 32)
+		ids, ok := groups[id]
+		if !ok {
+			ids = new(quenchIDs)
+			groups[id] = ids
+		}
+		if secure {
+			ids.secure = append(ids.secure, quenchID)
+		} else {
+			ids.insecure = append(ids.insecure, quenchID)
+		}
+	}
+	return groups
+}
+
+// Split an expression into its top level disjuncts
+func splitTerms(ast *elvin.AST) []*elvin.AST {
+	if ast == nil {
+		return nil
+	}
+	if ast.TypeCode == elvin.LogicalOrTypeCode {
+		return ast.Children
+	}
+	return []*elvin.AST{ast}
+}
+
+// A term's canonical form, used to compare terms
+func termKey(ast *elvin.AST) string {
+	return elvin.Format(ast)
+}
+
+// Collect the attribute names referenced by an expression
+func termNames(ast *elvin.AST, names map[string]bool) map[string]bool {
+	if names == nil {
+		names = make(map[string]bool)
+	}
+	if ast.TypeCode == elvin.NameTypeCode {
+		names[ast.Value.(string)] = true
+	}
+	for _, child := range ast.Children {
+		termNames(child, names)
+	}
+	return names
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+// Wait for a quench notification
+func quenchNotification(t *testing.T, quench *elvin.Quench) (n elvin.QuenchNotification) {
+	t.Helper()
+	select {
+	case n = <-quench.Notifications:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Too slow!")
+	}
+	return n
+}
+
+// Check that no quench notification arrives
+func noQuenchNotification(t *testing.T, quench *elvin.Quench) {
+	t.Helper()
+	select {
+	case n := <-quench.Notifications:
+		t.Fatalf("Unexpected quench notification %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuench(t *testing.T) {
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"QuenchTest": true}
+	quench.DeliverInsecure = true
+	quench.Notifications = make(chan elvin.QuenchNotification, 8) // replies may race notifications
+	if err := client.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+
+	// Only the term referencing the quenched name is sent
+	sub := new(elvin.Subscription)
+	sub.Expression = "Other > 2 || QuenchTest == 1"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	added := quenchNotification(t, quench)
+	if added.SubExpr == nil || added.SubExpr.TypeCode != elvin.EqualsTypeCode ||
+		added.SubExpr.Children[0].Value != "QuenchTest" {
+		t.Fatalf("Unexpected SubAddNotify %+v", added)
+	}
+	noQuenchNotification(t, quench)
+
+	// Modifying keeps the term's ID
+	if err := client.SubscriptionModify(sub, "QuenchTest > 5", true, nil, nil); err != nil {
+		t.Fatalf("SubscriptionModify failed %v", err)
+	}
+	modified := quenchNotification(t, quench)
+	if modified.TermID != added.TermID || modified.SubExpr == nil ||
+		modified.SubExpr.TypeCode != elvin.GreaterThanTypeCode {
+		t.Fatalf("Unexpected SubModNotify %+v %+v", modified, modified.SubExpr)
+	}
+
+	// Deleting it deletes the term
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed %v", err)
+	}
+	deleted := quenchNotification(t, quench)
+	if deleted.TermID != added.TermID || deleted.SubExpr != nil {
+		t.Fatalf("Unexpected SubDelNotify %+v", deleted)
+	}
+
+	// Existing subscriptions are sent to a new quench
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	quenchNotification(t, quench)
+
+	late := new(elvin.Quench)
+	late.Names = map[string]bool{"QuenchTest": true}
+	late.DeliverInsecure = true
+	late.Notifications = make(chan elvin.QuenchNotification, 8) // replies may race notifications
+	if err := client.Quench(late); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+	quenchNotification(t, late)
+
+	// Dropping the name from a quench deletes its terms
+	if err := client.QuenchModify(late, nil, map[string]bool{"QuenchTest": true}, true, nil, nil); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	if deleted := quenchNotification(t, late); deleted.SubExpr != nil {
+		t.Fatalf("Unexpected notification %+v", deleted)
+	}
+
+	if err := client.QuenchDelete(late); err != nil {
+		t.Fatalf("QuenchDelete failed %v", err)
+	}
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed %v", err)
+	}
+	quenchNotification(t, quench)
+	if err := client.QuenchDelete(quench); err != nil {
+		t.Fatalf("QuenchDelete failed %v", err)
+	}
+}
+
+func TestQuenchInsecure(t *testing.T) {
+	// A quench not accepting insecure delivery learns nothing
+	// about subscriptions without keys
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"QuenchSecure": true}
+	quench.DeliverInsecure = false
+	quench.Notifications = make(chan elvin.QuenchNotification, 8) // replies may race notifications
+	if err := client.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(QuenchSecure)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	noQuenchNotification(t, quench)
+
+	// Until it does
+	if err := client.QuenchModify(quench, nil, nil, true, nil, nil); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	if added := quenchNotification(t, quench); added.SubExpr == nil {
+		t.Fatalf("Unexpected notification %+v", added)
+	}
+
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed %v", err)
+	}
+	quenchNotification(t, quench)
+	if err := client.QuenchDelete(quench); err != nil {
+		t.Fatalf("QuenchDelete failed %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elvin"
+	"sync"
+)
+
+// Receive-Queue.Drop-Policy values, what to drop when a client's
+// queue is full
+const (
+	DropOldest  = iota // The longest queued packet
+	DropNewest         // The packet being queued
+	DropLargest        // The largest packet, queued or being queued
+	DropFail           // Nothing, the client is disconnected
+)
+
+// Drop policies by their connection option names
+var dropPolicies = map[string]int{
+	"oldest":  DropOldest,
+	"newest":  DropNewest,
+	"largest": DropLargest,
+	"fail":    DropFail,
+}
+
+// Receive-Queue.Max-Length in bytes until negotiated
+const DefaultReceiveQueueLength = 1024 * 1024
+
+// A packet awaiting the write handler
+type queuedPacket struct {
+	buf       *bytes.Buffer
+	droppable bool
+}
+
+// A client's bounded queue of packets for its write handler. Packets
+// the router sends of its own accord, such as notifications, are
+// droppable and subject to the drop policy once the queue holds
+// maxLength bytes, while replies and other packets the protocol
+// requires are always queued. Queuing never blocks so that the
+// router's goroutines don't wait on any one client.
+type deliveryQueue struct {
+	mu         sync.Mutex
+	packets    []queuedPacket
+	length     int           // Bytes queued
+	maxLength  int           // Receive-Queue.Max-Length
+	dropPolicy int           // Receive-Queue.Drop-Policy
+	dropWarn   bool          // A DropWarn is queued
+	closed     bool          // Nothing more may be queued
+	ready      chan struct{} // Signalled when packets are queued
+}
+
+// Create a queue with the default length and policy
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{
+		maxLength:  DefaultReceiveQueueLength,
+		dropPolicy: DropOldest,
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// Set the queue's length and drop policy
+func (q *deliveryQueue) Configure(maxLength int, dropPolicy int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxLength = maxLength
+	q.dropPolicy = dropPolicy
+}
+
+// The number of packets queued
+func (q *deliveryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.packets)
+}
+
+// Queue a packet that must not be dropped
+func (q *deliveryQueue) Push(buf *bytes.Buffer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		release(buf)
+		return
+	}
+	q.push(queuedPacket{buf, false})
+}
+
+// Queue the last packet the client will be sent, such as a Disconn.
+// Anything queued afterwards is discarded.
+func (q *deliveryQueue) PushLast(buf *bytes.Buffer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		release(buf)
+		return
+	}
+	q.push(queuedPacket{buf, false})
+	q.closed = true
+}
+
+// True once the last packet has been queued and taken
+func (q *deliveryQueue) Drained() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed && len(q.packets) == 0
+}
+
+// Queue a packet, dropping one if the queue is full. Returns false if
+// the drop policy is DropFail and the client should be disconnected.
+func (q *deliveryQueue) Deliver(buf *bytes.Buffer) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		release(buf)
+		return true
+	}
+
+	for q.length+buf.Len() > q.maxLength {
+		if q.dropPolicy == DropFail {
+			release(buf)
+			return false
+		}
+
+		i := q.victim(buf)
+		if i < 0 {
+			// Dropping the packet being queued
+			q.dropped(buf)
+			return true
+		}
+		victim := q.packets[i].buf
+		q.packets = append(q.packets[:i], q.packets[i+1:]...)
+		q.length -= victim.Len()
+		q.dropped(victim)
+	}
+
+	q.push(queuedPacket{buf, true})
+	return true
+}
+
+// Take everything queued, oldest first
+func (q *deliveryQueue) Take() (bufs []*bytes.Buffer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range q.packets {
+		bufs = append(bufs, p.buf)
+	}
+	q.packets = nil
+	q.length = 0
+	q.dropWarn = false
+	return bufs
+}
+
+func (q *deliveryQueue) push(p queuedPacket) {
+	q.packets = append(q.packets, p)
+	q.length += p.buf.Len()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Choose the index of the queued packet to drop to make room for
+// buf, or -1 if it's buf that should go
+func (q *deliveryQueue) victim(buf *bytes.Buffer) int {
+	victim := -1
+	switch q.dropPolicy {
+	case DropOldest:
+		for i, p := range q.packets {
+			if p.droppable {
+				return i
+			}
+		}
+
+	case DropLargest:
+		// The packet being queued goes if it's the largest
+		largest := buf.Len()
+		for i, p := range q.packets {
+			if p.droppable && p.buf.Len() > largest {
+				victim, largest = i, p.buf.Len()
+			}
+		}
+	}
+	return victim
+}
+
+// Release a dropped packet and warn the client, once per batch of
+// drops, with a DropWarn in its place
+func (q *deliveryQueue) dropped(buf *bytes.Buffer) {
+	release(buf)
+	if !q.dropWarn {
+		q.dropWarn = true
+		warn := bufferPool.Get().(*bytes.Buffer)
+		new(elvin.DropWarn).Encode(warn)
+		q.push(queuedPacket{warn, false})
+	}
+}
+
+// Return an unsent packet's buffer to the pool
+func release(buf *bytes.Buffer) {
+	buf.Reset()
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/cobaro/elvin/elvin"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A droppable packet of size bytes, tagged so it can be identified
+func queueTestPacket(size int, tag byte) *bytes.Buffer {
+	buf := bytes.NewBuffer(make([]byte, 4, size))
+	for buf.Len() < size {
+		buf.WriteByte(tag)
+	}
+	return buf
+}
+
+// Describe a queue's packets by their tags, with DropWarns as 'W'
+func queueTags(bufs []*bytes.Buffer) string {
+	var tags []byte
+	for _, buf := range bufs {
+		if elvin.PacketID(buf.Bytes()) == elvin.PacketDropWarn {
+			tags = append(tags, 'W')
+		} else {
+			tags = append(tags, buf.Bytes()[4])
+		}
+	}
+	return string(tags)
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	tests := []struct {
+		policy int
+		sizes  []int
+		tags   string
+	}{
+		{DropOldest, []int{40, 40, 40}, "bWc"},
+		{DropOldest, []int{40, 90}, "Wb"},
+		{DropNewest, []int{40, 40, 40}, "abW"},
+		{DropLargest, []int{30, 60, 30}, "aWc"},
+		{DropLargest, []int{30, 30, 60}, "abW"},
+		{DropLargest, []int{10, 60, 20, 50}, "acWd"},
+	}
+
+	for _, test := range tests {
+		q := newDeliveryQueue()
+		q.Configure(100, test.policy)
+		for i, size := range test.sizes {
+			if !q.Deliver(queueTestPacket(size, 'a'+byte(i))) {
+				t.Errorf("Deliver failed for policy %d", test.policy)
+			}
+		}
+		if tags := queueTags(q.Take()); tags != test.tags {
+			t.Errorf("Policy %d with %v queued %s, expected %s", test.policy, test.sizes, tags, test.tags)
+		}
+	}
+}
+
+func TestDeliveryQueueRequired(t *testing.T) {
+	q := newDeliveryQueue()
+	q.Configure(100, DropOldest)
+
+	// Required packets are always queued, so a droppable
+	// packet with nothing else to drop is dropped itself
+	q.Push(queueTestPacket(60, 'a'))
+	q.Push(queueTestPacket(60, 'b'))
+	q.Deliver(queueTestPacket(10, 'c'))
+	q.Deliver(queueTestPacket(10, 'd'))
+	if tags := queueTags(q.Take()); tags != "abW" {
+		t.Errorf("Queued %s", tags)
+	}
+
+	// There's a DropWarn for each batch of drops taken
+	q.Deliver(queueTestPacket(60, 'e'))
+	q.Deliver(queueTestPacket(60, 'f'))
+	if tags := queueTags(q.Take()); tags != "Wf" {
+		t.Errorf("Queued %s", tags)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Take left %d packets", q.Len())
+	}
+
+	// Failing rather than dropping
+	q.Configure(100, DropFail)
+	if !q.Deliver(queueTestPacket(60, 'g')) || q.Deliver(queueTestPacket(60, 'h')) {
+		t.Errorf("DropFail didn't fail")
+	}
+	if tags := queueTags(q.Take()); tags != "g" {
+		t.Errorf("Queued %s", tags)
+	}
+}
+
+// A client that stops reading mustn't stall delivery to others
+func TestSlowConsumer(t *testing.T) {
+	options := map[string]interface{}{
+		"Receive-Queue.Max-Length":  int32(64 * 1024),
+		"Receive-Queue.Drop-Policy": "newest",
+	}
+	slow := elvin.NewClient(testURL, options, nil, nil)
+	if err := slow.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	slowSub := new(elvin.Subscription)
+	slowSub.Expression = "require(SlowConsumerTest)"
+	slowSub.AcceptInsecure = true
+	slowSub.Notifications = make(chan map[string]interface{})
+	if err := slow.Subscribe(slowSub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// A consumer keeping up with room to spare
+	fast := elvin.NewClient(testURL, map[string]interface{}{"Receive-Queue.Max-Length": int32(10 * megabyte)}, nil, nil)
+	if err := fast.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(SlowConsumerTest)"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+	if err := fast.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+
+	// Enough to fill the socket buffers many times over, while
+	// never getting too far ahead of the fast consumer
+	const count = 1000
+	window := make(chan bool, 100)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		nfn := map[string]interface{}{"SlowConsumerTest": strings.Repeat("x", 32*1024)}
+		for i := 0; i < count; i++ {
+			window <- true
+			if err := client.Notify(nfn, true, nil); err != nil {
+				t.Errorf("Notify failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-sub.Notifications:
+			<-window
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Delivery stalled after %d notifications", i)
+		}
+	}
+	wg.Wait()
+
+	// Once the slow client catches up it's told of the drops
+	received := 0
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-slowSub.Notifications:
+				received++
+			case <-done:
+				return
+			}
+		}
+	}()
+	select {
+	case event := <-slow.Events:
+		if _, ok := event.(*elvin.DropWarn); !ok {
+			t.Errorf("Unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No DropWarn")
+	}
+
+	if err := slow.Disconnect(); err != nil {
+		t.Errorf("Disconnect failed: %v", err)
+	}
+	done <- true
+	if received >= count {
+		t.Errorf("Slow consumer received all %d notifications", received)
+	}
+	if err := fast.Disconnect(); err != nil {
+		t.Errorf("Disconnect failed: %v", err)
+	}
+}
@@ -34,11 +34,14 @@ import (
 
 // An Elvin router instance
 type Router struct {
-	Mu        sync.Mutex
-	listeners map[string]net.Listener
-	clients   map[int32]*Client // Required to be initialized by Init()
-	channels  ClientChannels    // For notifications, subs, quenches, delete etc to engine
-	elog      elog.Elog
+	Mu         sync.Mutex
+	listeners  map[string]net.Listener
+	clients    map[int32]*Client // Required to be initialized by Init()
+	channels   ClientChannels    // For notifications, subs, quenches, delete etc to engine
+	matcher    Matcher           // Subscription index maintained by Subscriptions()
+	predicates Predicates        // Compiled subscriptions sharing common predicates
+	quencher   Quencher          // Subscription terms for quenching clients
+	elog       elog.Elog
 
 	// Configurable
 	protocols        map[string]*elvin.Protocol
@@ -47,6 +50,8 @@ type Router struct {
 	testConnTimeout  time.Duration
 	maxConnections   int
 	doFailover       bool
+	expressionLimits elvin.ExpressionLimits
+	connectionLimits map[string]int
 	logLevel         int
 	logFormat        int
 	logPath          string // FIXME: implement
@@ -58,7 +63,7 @@ type Router struct {
 
 // Operations from a client handled via channel to clients
 type ClientChannels struct {
-	remove    chan int32         // Client removal channel
+	remove    chan *Client       // Client removal channel
 	notify    chan Notification  // Notifications
 	subAdd    chan *Subscription // Subscription Add
 	subMod    chan *Subscription // Subscription Mod
@@ -66,6 +71,7 @@ type ClientChannels struct {
 	quenchAdd chan *Quench       // Quench Add
 	quenchMod chan *Quench       // Quench Mod
 	quenchDel chan *Quench       // Quench Del
+	keysMod   chan *Client       // Connection keys Mod
 }
 
 // Set the maximum allowed number of clients
@@ -110,6 +116,35 @@ func (router *Router) TestConnTimeout() time.Duration {
 	return router.testConnTimeout
 }
 
+// Set the limits on clients' subscription expressions
+func (router *Router) SetExpressionLimits(limits elvin.ExpressionLimits) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.expressionLimits = limits
+}
+
+// Get the limits on clients' subscription expressions
+func (router *Router) ExpressionLimits() elvin.ExpressionLimits {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.expressionLimits
+}
+
+// Set the limits on integer connection options negotiated by clients,
+// by option name
+func (router *Router) SetConnectionLimits(limits map[string]int) {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	router.connectionLimits = limits
+}
+
+// Get the limits on integer connection options
+func (router *Router) ConnectionLimits() map[string]int {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.connectionLimits
+}
+
 // Set the maximum allowed number of clients
 func (router *Router) SetDoFailover(failover bool) {
 	router.Mu.Lock()
@@ -238,7 +273,7 @@ func (router *Router) Failover() {
 	for _, c := range router.clients {
 		buf := bufferPool.Get().(*bytes.Buffer)
 		disconn.Encode(buf)
-		c.writeChannel <- buf
+		c.send(buf)
 	}
 	return
 }
@@ -246,7 +281,7 @@ func (router *Router) Failover() {
 // Router initialization
 func (router *Router) Init() {
 	router.clients = make(map[int32]*Client)
-	router.channels.remove = make(chan int32)
+	router.channels.remove = make(chan *Client)
 	router.channels.notify = make(chan Notification)
 	router.channels.subAdd = make(chan *Subscription)
 	router.channels.subMod = make(chan *Subscription)
@@ -254,6 +289,10 @@ func (router *Router) Init() {
 	router.channels.quenchAdd = make(chan *Quench)
 	router.channels.quenchMod = make(chan *Quench)
 	router.channels.quenchDel = make(chan *Quench)
+	router.channels.keysMod = make(chan *Client)
+	router.matcher.Init()
+	router.predicates.Init()
+	router.quencher.Init(router)
 	router.initialized = true
 
 	// Start remove goroutine for client cleanup
@@ -333,7 +372,7 @@ func (router *Router) Stop() (err error) {
 	for _, c := range router.clients {
 		buf := bufferPool.Get().(*bytes.Buffer)
 		disconn.Encode(buf)
-		c.writeChannel <- buf
+		c.send(buf)
 	}
 
 	// FIXME: Shut down our goroutines
@@ -383,11 +422,17 @@ func (router *Router) Listener(name string, protocol *elvin.Protocol) (err error
 		client.closer = conn
 		client.testConnInterval = router.testConnInterval
 		client.testConnTimeout = router.testConnTimeout
+		client.expressionLimits = router.expressionLimits
+		client.connectionLimits = router.connectionLimits
 
 		client.SetState(StateNew)
-		// Some queuing allowed to smooth things out
-		client.writeChannel = make(chan *bytes.Buffer, 4)
+		client.queue = newDeliveryQueue()
 		client.writeTerminate = make(chan int)
+		client.writeDone = make(chan struct{})
+
+		// Until it connects a client gets the default options
+		options, _ := negotiateOptions(nil, client.connectionLimits)
+		client.applyOptions(options)
 
 		router.AddClient(&client) // track it
 		go client.readHandler()
@@ -415,16 +460,45 @@ func (router *Router) AddClient(conn *Client) {
 	return
 }
 
-// Remove will purge a client from the set of clients (run as goroutine)
+// Look up a client by id, returning nil if it has gone
+func (router *Router) client(id int32) *Client {
+	router.Mu.Lock()
+	defer router.Mu.Unlock()
+	return router.clients[id]
+}
+
+// Remove will purge a client from the set of clients along with its
+// subscriptions and quenches (run as goroutine)
 func (router *Router) RemoveClient() {
 	for {
-		id := <-router.channels.remove
-		router.elog.Logf(elog.LogLevelDebug1, "Remove client %d", id)
+		client := <-router.channels.remove
 
+		// A client may be removed more than once, such as on a
+		// DisconnRequest and again when its connection closes,
+		// by which time its id may have been reused
 		router.Mu.Lock()
-		delete(router.clients, id)
+		current := router.clients[client.ID()]
+		if current == client {
+			delete(router.clients, client.ID())
+		}
 		router.Mu.Unlock()
-		// FIXME: Clean up the subscriptions and quenches
+		if current != client {
+			continue
+		}
+		router.elog.Logf(elog.LogLevelDebug1, "Remove client %d", client.ID())
+
+		// The client no longer handles requests so its
+		// subscriptions and quenches are ours to delete. They go
+		// via the same channels as its own requests did to stay
+		// in order, and quenching clients are sent SubDelNotifys.
+		for idx, quench := range client.quenches {
+			delete(client.quenches, idx)
+			router.channels.quenchDel <- quench
+		}
+		for idx, sub := range client.subs {
+			delete(client.subs, idx)
+			router.channels.subDel <- sub
+		}
 	}
 }
 
@@ -434,80 +508,101 @@ func (router *Router) Notify() {
 		nfn := <-router.channels.notify
 		router.elog.Logf(elog.LogLevelDebug3, "notification %+v", nfn)
 
-		// FIXME: eval
-		// As a dummy for now we're going to send every message we see
-		// to every subscription as if all evaluate to true.
-		deliver := new(elvin.NotifyDeliver)
-		deliver.NameValue = nfn.NameValue
-
-		// Grab a copy of the current client list
-		// For now we don't care if one updates mid stream
-		router.Mu.Lock()
-		clients := router.clients
-		router.Mu.Unlock()
+		// Evaluate only the plausible candidates, grouping
+		// those that match by client
+		router.predicates.Begin()
+		matches := make(map[int32][]*Subscription)
+		for _, sub := range router.matcher.Candidates(nfn.NameValue) {
+			if sub.Predicate == nil || sub.Predicate(nfn.NameValue) != elvin.LukTrue {
+				continue
+			}
+			id := int32(sub.SubID >> 32)
+			matches[id] = append(matches[id], sub)
+		}
 
-		for connid, client := range clients {
-			if len(client.subs) > 0 {
-				deliver.Insecure = make([]int64, len(client.subs))
-				i := 0
-				for id, sub := range client.subs {
-					// Security check first
-					PrimeProducer(nfn.Keys)
-
-					if SecurityMatches(nfn, *sub, nfn.ClientKeys, client.keysSub) {
-						router.elog.Logf(elog.LogLevelDebug1, "SecurityMatches true")
-						deliver.Insecure[i] = int64(connid)<<32 | int64(id)
-						i++
-					} else {
-						router.elog.Logf(elog.LogLevelDebug1, "SecurityMatches false")
-					}
+		for id, subs := range matches {
+			client := router.client(id)
+			if client == nil {
+				continue
+			}
 
+			// Subscriptions whose keys match are delivered securely,
+			// otherwise they may still be delivered insecurely
+			var secure, insecure []int64
+			_, keysSub := client.connectionKeys()
+			for _, sub := range subs {
+				if KeysMatch(nfn, *sub, nfn.ClientKeys, keysSub) {
+					secure = append(secure, sub.SubID)
+				} else if SecurityMatches(nfn, *sub, nfn.ClientKeys, keysSub) {
+					insecure = append(insecure, sub.SubID)
+				} else {
+					router.elog.Logf(elog.LogLevelDebug3, "SecurityMatches false for %d", sub.SubID)
 				}
-				buf := bufferPool.Get().(*bytes.Buffer)
-				deliver.Encode(buf)
-				client.writeChannel <- buf
 			}
+
+			// Nothing matched so nothing to send
+			if len(secure) == 0 && len(insecure) == 0 {
+				continue
+			}
+
+			deliver := new(elvin.NotifyDeliver)
+			deliver.NameValue = nfn.NameValue
+			deliver.Secure = secure
+			deliver.Insecure = insecure
+
+			buf := bufferPool.Get().(*bytes.Buffer)
+			deliver.Encode(buf)
+			client.deliver(buf)
 		}
 	}
 }
 
-// FIXME: implement
-// Subscriptions deals with changes to all of our client's subscriptions (run as goroutine)
+// Subscriptions deals with changes to all of our client's subscriptions
+// by compiling them and maintaining the matcher's index (run as goroutine)
 func (router *Router) Subscriptions() {
 	for {
-		var sub *Subscription
 		select {
-		case sub = <-router.channels.subAdd:
-			router.elog.Logf(elog.LogLevelInfo2, "SubAdd")
-		case sub = <-router.channels.subMod:
-			router.elog.Logf(elog.LogLevelInfo2, "SubMod")
-		case sub = <-router.channels.subDel:
-			router.elog.Logf(elog.LogLevelInfo2, "SubDel")
-		}
-
-		if sub.SubID == 0 {
-			router.elog.Logf(elog.LogLevelError, "FIXME: Use sub to keep compiler happy")
+		case sub := <-router.channels.subAdd:
+			router.elog.Logf(elog.LogLevelDebug2, "SubAdd %d", sub.SubID)
+			router.predicates.Add(sub)
+			router.matcher.Add(sub)
+			router.quencher.SubAdd(sub)
+		case sub := <-router.channels.subMod:
+			router.elog.Logf(elog.LogLevelDebug2, "SubMod %d", sub.SubID)
+			router.predicates.Modify(sub)
+			router.matcher.Modify(sub)
+			router.quencher.SubMod(sub)
+		case sub := <-router.channels.subDel:
+			router.elog.Logf(elog.LogLevelDebug2, "SubDel %d", sub.SubID)
+			router.matcher.Delete(sub)
+			router.predicates.Delete(sub)
+			router.quencher.SubDel(sub)
 		}
-
 	}
 }
 
-// FIXME: implement
-// Quenches deals with quencehs to all of our client's quenches (run as goroutine)
+// Statistics on the sharing of predicates between subscriptions
+func (router *Router) PredicateStats() PredicateStats {
+	return router.predicates.Stats()
+}
+
+// Quenches deals with changes to all of our client's quenches by
+// keeping the quencher up to date (run as goroutine)
 func (router *Router) Quenches() {
 	for {
-		var quench *Quench
 		select {
-		case quench = <-router.channels.quenchAdd:
-			router.elog.Logf(elog.LogLevelInfo2, "QuenchAdd")
-		case quench = <-router.channels.quenchMod:
-			router.elog.Logf(elog.LogLevelInfo2, "QuenchMod")
-		case quench = <-router.channels.quenchDel:
-			router.elog.Logf(elog.LogLevelInfo2, "QuenchDel")
-		}
-		if quench.QuenchID == 0 {
-			router.elog.Logf(elog.LogLevelError, "FIXME: Use quench to keep compiler happy")
+		case quench := <-router.channels.quenchAdd:
+			router.elog.Logf(elog.LogLevelDebug2, "QuenchAdd %d", quench.QuenchID)
+			router.quencher.QuenchAdd(quench)
+		case quench := <-router.channels.quenchMod:
+			router.elog.Logf(elog.LogLevelDebug2, "QuenchMod %d", quench.QuenchID)
+			router.quencher.QuenchMod(quench)
+		case quench := <-router.channels.quenchDel:
+			router.elog.Logf(elog.LogLevelDebug2, "QuenchDel %d", quench.QuenchID)
+			router.quencher.QuenchDel(quench)
+		case client := <-router.channels.keysMod:
+			router.elog.Logf(elog.LogLevelDebug2, "KeysMod %d", client.ID())
+			router.quencher.KeysMod(client.ID())
 		}
 	}
-
 }
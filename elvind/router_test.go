@@ -0,0 +1,134 @@
+// Copyright 2018 Cobaro Pty Ltd. All Rights Reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cobaro/elvin/elvin"
+	"testing"
+	"time"
+)
+
+// The number of clients, subscriptions and quenches in each of the
+// router's indexes
+type routerCounts struct {
+	clients       int
+	matcher       int
+	predicates    PredicateStats
+	subscriptions int
+	terms         int
+	quenches      int
+}
+
+func countRouter(router *Router) (counts routerCounts) {
+	router.Mu.Lock()
+	counts.clients = len(router.clients)
+	router.Mu.Unlock()
+
+	counts.matcher = router.matcher.Len()
+	counts.predicates = router.predicates.Stats()
+	counts.predicates.Evaluated, counts.predicates.Reused = 0, 0
+
+	router.quencher.mu.Lock()
+	counts.subscriptions = len(router.quencher.terms)
+	for name := range router.quencher.byName {
+		counts.terms += len(router.quencher.byName[name])
+	}
+	counts.quenches = len(router.quencher.quenches)
+	router.quencher.mu.Unlock()
+	return counts
+}
+
+// Wait for the router's indexes to reach the expected counts as
+// removal is asynchronous
+func waitForCounts(t *testing.T, router *Router, expected routerCounts) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		counts := countRouter(router)
+		if counts == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Router leaked: expected %+v, got %+v", expected, counts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveClient(t *testing.T) {
+	baseline := countRouter(testRouter)
+
+	// Our client quenches the name the departing clients subscribe to
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"RemoveTest": true}
+	quench.DeliverInsecure = true
+	quench.Notifications = make(chan elvin.QuenchNotification, 8) // replies may race notifications
+	if err := client.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+	withQuench := countRouter(testRouter)
+
+	for i := 0; i < 50; i++ {
+		c := elvin.NewClient(testURL, nil, nil, nil)
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+
+		for j := 0; j < 3; j++ {
+			sub := new(elvin.Subscription)
+			sub.Expression = fmt.Sprintf("RemoveTest == %d || Shared == 'x'", j)
+			sub.AcceptInsecure = true
+			sub.Notifications = make(chan map[string]interface{})
+			if err := c.Subscribe(sub); err != nil {
+				t.Fatalf("Subscribe failed %v", err)
+			}
+			if added := quenchNotification(t, quench); added.SubExpr == nil {
+				t.Fatalf("Unexpected notification %+v", added)
+			}
+		}
+
+		q := new(elvin.Quench)
+		q.Names = map[string]bool{"Shared": true}
+		q.DeliverInsecure = true
+		q.Notifications = make(chan elvin.QuenchNotification, 8)
+		if err := c.Quench(q); err != nil {
+			t.Fatalf("Quench failed %v", err)
+		}
+
+		if err := c.Disconnect(); err != nil {
+			t.Fatalf("Disconnect failed: %v", err)
+		}
+
+		// Each of the subscriptions' terms is deleted
+		for j := 0; j < 3; j++ {
+			if deleted := quenchNotification(t, quench); deleted.SubExpr != nil {
+				t.Fatalf("Unexpected notification %+v", deleted)
+			}
+		}
+	}
+
+	waitForCounts(t, testRouter, withQuench)
+	if err := client.QuenchDelete(quench); err != nil {
+		t.Fatalf("QuenchDelete failed %v", err)
+	}
+	waitForCounts(t, testRouter, baseline)
+}
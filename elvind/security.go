@@ -43,28 +43,40 @@ import (
 // and consumer connections keys we might mark (cache)a pair as
 // matching updating as needed.
 
-// Prime (run through one way func) a KeyBlock
+// Prime (run through one way func) a KeyBlock. Keys are primed in
+// place exactly once, as they arrive on a connection, subscription,
+// quench or notification, so anything matched against them must
+// already be primed.
+
+// The one way function of a scheme
+func primeFunc(scheme int) func(elvin.Key) elvin.Key {
+	switch scheme {
+	case elvin.KeySchemeSha1Dual, elvin.KeySchemeSha1Producer, elvin.KeySchemeSha1Consumer:
+		return elvin.PrimeSha1
+	case elvin.KeySchemeSha256Dual, elvin.KeySchemeSha256Producer, elvin.KeySchemeSha256Consumer:
+		return elvin.PrimeSha256
+	}
+	return nil
+}
+
+// Prime the keys of one KeySet in a KeySetList, if there is one
+func primeKeySet(ksl elvin.KeySetList, index int, prime func(elvin.Key) elvin.Key) {
+	if index >= len(ksl) {
+		return
+	}
+	for i, raw := range ksl[index] {
+		ksl[index][i] = prime(raw)
+	}
+}
 
 // Prime a consumer
 func PrimeConsumer(keys elvin.KeyBlock) {
 	for scheme, ksl := range keys {
 		switch scheme {
-		case elvin.KeySchemeSha1Consumer:
-			for i, raw := range ksl[elvin.KeySetConsumer] {
-				ksl[elvin.KeySetConsumer][i] = elvin.PrimeSha1(raw)
-			}
-		case elvin.KeySchemeSha1Dual:
-			for i, raw := range ksl[elvin.KeySetDualConsumer] {
-				ksl[elvin.KeySetDualConsumer][i] = elvin.PrimeSha1(raw)
-			}
-		case elvin.KeySchemeSha256Consumer:
-			for i, raw := range ksl[elvin.KeySetConsumer] {
-				ksl[elvin.KeySetConsumer][i] = elvin.PrimeSha256(raw)
-			}
-		case elvin.KeySchemeSha256Dual:
-			for i, raw := range ksl[elvin.KeySetDualConsumer] {
-				ksl[elvin.KeySetDualConsumer][i] = elvin.PrimeSha256(raw)
-			}
+		case elvin.KeySchemeSha1Consumer, elvin.KeySchemeSha256Consumer:
+			primeKeySet(ksl, elvin.KeySetConsumer, primeFunc(scheme))
+		case elvin.KeySchemeSha1Dual, elvin.KeySchemeSha256Dual:
+			primeKeySet(ksl, elvin.KeySetDualConsumer, primeFunc(scheme))
 		}
 	}
 }
@@ -73,22 +85,10 @@ func PrimeConsumer(keys elvin.KeyBlock) {
 func PrimeProducer(keys elvin.KeyBlock) {
 	for scheme, ksl := range keys {
 		switch scheme {
-		case elvin.KeySchemeSha1Producer:
-			for i, raw := range ksl[elvin.KeySetProducer] {
-				ksl[elvin.KeySetProducer][i] = elvin.PrimeSha1(raw)
-			}
-		case elvin.KeySchemeSha1Dual:
-			for i, raw := range ksl[elvin.KeySetDualProducer] {
-				ksl[elvin.KeySetDualProducer][i] = elvin.PrimeSha1(raw)
-			}
-		case elvin.KeySchemeSha256Producer:
-			for i, raw := range ksl[elvin.KeySetProducer] {
-				ksl[elvin.KeySetProducer][i] = elvin.PrimeSha256(raw)
-			}
-		case elvin.KeySchemeSha256Dual:
-			for i, raw := range ksl[elvin.KeySetDualProducer] {
-				ksl[elvin.KeySetDualProducer][i] = elvin.PrimeSha256(raw)
-			}
+		case elvin.KeySchemeSha1Producer, elvin.KeySchemeSha256Producer:
+			primeKeySet(ksl, elvin.KeySetProducer, primeFunc(scheme))
+		case elvin.KeySchemeSha1Dual, elvin.KeySchemeSha256Dual:
+			primeKeySet(ksl, elvin.KeySetDualProducer, primeFunc(scheme))
 		}
 	}
 }
@@ -116,6 +116,12 @@ func SecurityMatches(nfn Notification, sub Subscription, pKeys, cKeys elvin.KeyB
 	}
 
 	// We got here cos we have to deal with keys
+	return KeysMatch(nfn, sub, pKeys, cKeys)
+}
+
+// Do the keys match, regardless of whether either side would accept
+// insecure delivery. A match means the notification is delivered securely.
+func KeysMatch(nfn Notification, sub Subscription, pKeys, cKeys elvin.KeyBlock) bool {
 
 	// We could merge togther the connection and notification/subscription
 	// keys but it's simpler just to run the combinations
@@ -137,37 +143,47 @@ func SecurityMatches(nfn Notification, sub Subscription, pKeys, cKeys elvin.KeyB
 	return false
 }
 
+// Do a producer's and a consumer's primed KeyBlocks share a scheme
+// under which they match. For the dual schemes both the producer and
+// the consumer KeySets must match.
 func KeyBlocksMatches(producer, consumer elvin.KeyBlock) bool {
 	if len(producer) == 0 || len(consumer) == 0 {
 		return false
 	}
 	for scheme, ksl := range producer {
-		if _, ok := consumer[scheme]; !ok {
+		other, ok := consumer[scheme]
+		if !ok {
 			// No matching scheme
 			continue
 		}
 		switch scheme {
-		case elvin.KeySchemeSha1Dual:
-			if KeySetMatches(ksl[elvin.KeySetDualProducer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualProducer]) && KeySetMatches(ksl[elvin.KeySetDualConsumer], consumer[elvin.KeySchemeSha1Dual][elvin.KeySetDualConsumer]) {
+		case elvin.KeySchemeSha1Dual, elvin.KeySchemeSha256Dual:
+			if KeySetMatches(keySet(ksl, elvin.KeySetDualProducer), keySet(other, elvin.KeySetDualProducer)) &&
+				KeySetMatches(keySet(ksl, elvin.KeySetDualConsumer), keySet(other, elvin.KeySetDualConsumer)) {
 				return true
 			}
-		case elvin.KeySchemeSha1Producer:
-			if KeySetMatches(ksl[elvin.KeySetProducer], consumer[elvin.KeySchemeSha1Producer][elvin.KeySetProducer]) {
+		case elvin.KeySchemeSha1Producer, elvin.KeySchemeSha256Producer:
+			if KeySetMatches(keySet(ksl, elvin.KeySetProducer), keySet(other, elvin.KeySetProducer)) {
 				return true
 			}
-		case elvin.KeySchemeSha1Consumer:
-			if KeySetMatches(ksl[elvin.KeySetConsumer], consumer[elvin.KeySchemeSha1Consumer][elvin.KeySetConsumer]) {
+		case elvin.KeySchemeSha1Consumer, elvin.KeySchemeSha256Consumer:
+			if KeySetMatches(keySet(ksl, elvin.KeySetConsumer), keySet(other, elvin.KeySetConsumer)) {
 				return true
 			}
-		case elvin.KeySchemeSha256Dual:
-		case elvin.KeySchemeSha256Producer:
-		case elvin.KeySchemeSha256Consumer:
 		}
 	}
 
 	return false
 }
 
+// A KeySet of a KeySetList, or nil if a client sent too few
+func keySet(ksl elvin.KeySetList, index int) elvin.KeySet {
+	if index >= len(ksl) {
+		return nil
+	}
+	return ksl[index]
+}
+
 // A match occurs if there is a match across any of the two sets of keys
 func KeySetMatches(first, second elvin.KeySet) bool {
 	for _, f := range first {
@@ -179,3 +195,19 @@ func KeySetMatches(first, second elvin.KeySet) bool {
 	}
 	return false
 }
+
+// How many of keys are held in a KeyBlock, and how many there are
+func keyBlockFind(block, keys elvin.KeyBlock) (found, total int) {
+	for scheme, ksl := range keys {
+		for i, ks := range ksl {
+			held := keySet(block[scheme], i)
+			for _, key := range ks {
+				total++
+				if KeySetMatches(held, elvin.KeySet{key}) {
+					found++
+				}
+			}
+		}
+	}
+	return found, total
+}
@@ -23,8 +23,11 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"github.com/cobaro/elvin/elvin"
+	"strings"
 	"testing"
+	"time"
 )
 
 var k1 = []byte("foo")
@@ -167,7 +170,7 @@ func TestMatching(t *testing.T) {
 	consumerKeyBlock[elvin.KeySchemeSha1Producer] = consumerKeySetList
 
 	// Make s subscription with that keyBlock that must match
-	sub := Subscription{1, false, consumerKeyBlock, nil}
+	sub := Subscription{SubID: 1, AcceptInsecure: false, Keys: consumerKeyBlock}
 
 	// Because the producer key is not yet primed, these should not match
 	if SecurityMatches(nfn, sub, nil, nil) {
@@ -215,3 +218,495 @@ func TestMatching(t *testing.T) {
 		t.Fatalf("empty subscriber keys should not match")
 	}
 }
+
+// Test that only key matches count as secure
+func TestKeysMatch(t *testing.T) {
+
+	// No keys anywhere so only insecure delivery is possible
+	nfn := Notification{nil, namevalue, true, nil}
+	sub := Subscription{SubID: 1, AcceptInsecure: true}
+	if KeysMatch(nfn, sub, nil, nil) {
+		t.Fatalf("no keys should not match securely")
+	}
+	if !SecurityMatches(nfn, sub, nil, nil) {
+		t.Fatalf("insecure notification and subscription should match")
+	}
+
+	// Primed producer keys against the consumer's copy
+	var producerKeySet elvin.KeySet
+	producerKeySet = append(producerKeySet, elvin.PrimeSha1(k2))
+	producerKeyBlock := make(map[int]elvin.KeySetList)
+	producerKeyBlock[elvin.KeySchemeSha1Producer] = elvin.KeySetList{producerKeySet}
+
+	var consumerKeySet elvin.KeySet
+	consumerKeySet = append(consumerKeySet, elvin.PrimeSha1(k2))
+	consumerKeyBlock := make(map[int]elvin.KeySetList)
+	consumerKeyBlock[elvin.KeySchemeSha1Producer] = elvin.KeySetList{consumerKeySet}
+
+	nfn.Keys = producerKeyBlock
+	if KeysMatch(nfn, sub, nil, nil) {
+		t.Fatalf("missing consumer keys should not match securely")
+	}
+	if !KeysMatch(nfn, sub, nil, consumerKeyBlock) {
+		t.Fatalf("consumer connection keys should match securely")
+	}
+	sub.Keys = consumerKeyBlock
+	if !KeysMatch(nfn, sub, nil, nil) {
+		t.Fatalf("subscription keys should match securely")
+	}
+}
+
+var keySchemes = []int{
+	elvin.KeySchemeSha1Dual,
+	elvin.KeySchemeSha1Producer,
+	elvin.KeySchemeSha1Consumer,
+	elvin.KeySchemeSha256Dual,
+	elvin.KeySchemeSha256Producer,
+	elvin.KeySchemeSha256Consumer,
+}
+
+// The unprimed KeyBlocks a producer and a consumer sharing a secret
+// would send for a scheme
+func schemeKeyBlocks(scheme int, secret elvin.Key) (producer, consumer elvin.KeyBlock) {
+	public := primeFunc(scheme)(secret)
+	switch scheme {
+	case elvin.KeySchemeSha1Producer, elvin.KeySchemeSha256Producer:
+		return elvin.KeyBlock{scheme: {{secret}}}, elvin.KeyBlock{scheme: {{public}}}
+	case elvin.KeySchemeSha1Consumer, elvin.KeySchemeSha256Consumer:
+		return elvin.KeyBlock{scheme: {{public}}}, elvin.KeyBlock{scheme: {{secret}}}
+	default:
+		return elvin.KeyBlock{scheme: {{secret}, {public}}}, elvin.KeyBlock{scheme: {{public}, {secret}}}
+	}
+}
+
+// Every scheme with keys on the notification or producer's connection
+// against keys on the subscription or consumer's connection
+func TestKeySchemes(t *testing.T) {
+	for _, scheme := range keySchemes {
+		for _, producerLevel := range []string{"notification", "connection"} {
+			for _, consumerLevel := range []string{"subscription", "connection"} {
+				for _, secret := range []elvin.Key{k1, k2} {
+					producer, _ := schemeKeyBlocks(scheme, k1)
+					_, consumer := schemeKeyBlocks(scheme, secret)
+					PrimeProducer(producer)
+					PrimeConsumer(consumer)
+
+					nfn := Notification{nil, namevalue, false, nil}
+					sub := Subscription{SubID: 1, AcceptInsecure: false}
+					var pKeys, cKeys elvin.KeyBlock
+					if producerLevel == "notification" {
+						nfn.Keys = producer
+					} else {
+						pKeys = producer
+					}
+					if consumerLevel == "subscription" {
+						sub.Keys = consumer
+					} else {
+						cKeys = consumer
+					}
+
+					expected := bytes.Equal(secret, k1)
+					if SecurityMatches(nfn, sub, pKeys, cKeys) != expected || KeysMatch(nfn, sub, pKeys, cKeys) != expected {
+						t.Errorf("Scheme %d with %s and %s keys (secret %s) didn't give %v", scheme, producerLevel, consumerLevel, secret, expected)
+					}
+				}
+			}
+		}
+	}
+
+	// Keys only match under the same scheme
+	producer, _ := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	_, consumer := schemeKeyBlocks(elvin.KeySchemeSha1Producer, k1)
+	PrimeProducer(producer)
+	PrimeConsumer(consumer)
+	if KeyBlocksMatches(producer, consumer) {
+		t.Errorf("Keys matched across schemes")
+	}
+
+	// A dual scheme needs both KeySets and copes without them
+	producer, consumer = schemeKeyBlocks(elvin.KeySchemeSha256Dual, k1)
+	PrimeProducer(producer)
+	consumer[elvin.KeySchemeSha256Dual] = consumer[elvin.KeySchemeSha256Dual][:1]
+	PrimeConsumer(consumer)
+	if KeyBlocksMatches(producer, consumer) {
+		t.Errorf("Dual scheme matched on its producer keys alone")
+	}
+}
+
+// Every scheme through the router with keys on the notification and
+// subscription or on the connections
+func TestKeySchemeDelivery(t *testing.T) {
+	for _, scheme := range keySchemes {
+		for _, level := range []string{"notification", "connection"} {
+			producerKeys, consumerKeys := schemeKeyBlocks(scheme, k1)
+
+			var producer, consumer *elvin.Client
+			sub := new(elvin.Subscription)
+			sub.Expression = "require(TestKeySchemeDelivery)"
+			sub.AcceptInsecure = false
+			sub.Notifications = make(chan map[string]interface{})
+			var nfnKeys elvin.KeyBlock
+			if level == "notification" {
+				producer = elvin.NewClient(testURL, nil, nil, nil)
+				consumer = elvin.NewClient(testURL, nil, nil, nil)
+				nfnKeys = producerKeys
+				sub.Keys = consumerKeys
+			} else {
+				producer = elvin.NewClient(testURL, nil, producerKeys, nil)
+				consumer = elvin.NewClient(testURL, nil, nil, consumerKeys)
+			}
+			if err := producer.Connect(); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			if err := consumer.Connect(); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			if err := consumer.Subscribe(sub); err != nil {
+				t.Fatalf("Subscribe failed: %v", err)
+			}
+
+			// Without keys nothing is delivered, with them it is
+			if err := client.Notify(map[string]interface{}{"TestKeySchemeDelivery": "insecure"}, false, nil); err != nil {
+				t.Fatalf("Notify failed: %v", err)
+			}
+			if err := producer.Notify(map[string]interface{}{"TestKeySchemeDelivery": "secure"}, false, nfnKeys); err != nil {
+				t.Fatalf("Notify failed: %v", err)
+			}
+			select {
+			case nfn := <-sub.Notifications:
+				if nfn["TestKeySchemeDelivery"] != "secure" {
+					t.Errorf("Scheme %d with %s keys delivered %v", scheme, level, nfn)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("Scheme %d with %s keys delivered nothing", scheme, level)
+			}
+
+			producer.Disconnect()
+			consumer.Disconnect()
+		}
+	}
+}
+
+// Connection keys changed without reconnecting
+func TestSetConnectionKeys(t *testing.T) {
+	producer := elvin.NewClient(testURL, nil, nil, nil)
+	consumer := elvin.NewClient(testURL, nil, nil, nil)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer producer.Disconnect()
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer consumer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestSetConnectionKeys)"
+	sub.AcceptInsecure = false
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	producerKeys, consumerKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := producer.SetConnectionKeys(producerKeys, nil, nil, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	if err := consumer.SetConnectionKeys(nil, nil, consumerKeys, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	if producerKeyCount(producer.KeysNfn) != 1 {
+		t.Errorf("Local keys not updated: %v", producer.KeysNfn)
+	}
+
+	notify := func(value string) {
+		if err := producer.Notify(map[string]interface{}{"TestSetConnectionKeys": value}, false, nil); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	expect := func(value string) {
+		select {
+		case nfn := <-sub.Notifications:
+			if nfn["TestSetConnectionKeys"] != value {
+				t.Errorf("Received %v, expected %s", nfn, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Nothing received, expected %s", value)
+		}
+	}
+	notify("added")
+	expect("added")
+
+	// Adding a key twice or deleting one that isn't there fails
+	producerKeys, _ = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	err := producer.SetConnectionKeys(producerKeys, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsKeyExists)) {
+		t.Errorf("Adding a key twice returned %v", err)
+	}
+	unknownKeys, _ := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k2)
+	err = producer.SetConnectionKeys(nil, unknownKeys, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsNoSuchKey)) {
+		t.Errorf("Deleting an unknown key returned %v", err)
+	}
+
+	// Without the key nothing is delivered
+	if err := producer.SetConnectionKeys(nil, producerKeys, nil, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	if producerKeyCount(producer.KeysNfn) != 0 {
+		t.Errorf("Local keys not updated: %v", producer.KeysNfn)
+	}
+	notify("deleted")
+	producerKeys, _ = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := producer.SetConnectionKeys(producerKeys, nil, nil, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	notify("restored")
+	expect("restored")
+}
+
+// Quenches follow changes to both the quencher's and the subscriber's
+// connection keys
+func TestQuenchConnectionKeys(t *testing.T) {
+	quencher := elvin.NewClient(testURL, nil, nil, nil)
+	consumer := elvin.NewClient(testURL, nil, nil, nil)
+	if err := quencher.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer quencher.Disconnect()
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer consumer.Disconnect()
+
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"TestQuenchConnectionKeys": true}
+	quench.DeliverInsecure = false
+	quench.Notifications = make(chan elvin.QuenchNotification, 8)
+	if err := quencher.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestQuenchConnectionKeys)"
+	sub.AcceptInsecure = false
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	producerKeys, consumerKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := consumer.SetConnectionKeys(nil, nil, consumerKeys, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	noQuenchNotification(t, quench)
+
+	// The quencher's keys now match the subscriber's
+	if err := quencher.SetConnectionKeys(producerKeys, nil, nil, nil); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	added := quenchNotification(t, quench)
+	if added.SubExpr == nil {
+		t.Fatalf("Unexpected notification %+v", added)
+	}
+
+	// And no longer once the subscriber's have gone
+	_, consumerKeys = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := consumer.SetConnectionKeys(nil, nil, nil, consumerKeys); err != nil {
+		t.Fatalf("SetConnectionKeys failed: %v", err)
+	}
+	deleted := quenchNotification(t, quench)
+	if deleted.TermID != added.TermID || deleted.SubExpr != nil {
+		t.Fatalf("Unexpected notification %+v", deleted)
+	}
+}
+
+// A subscription's keys are kept as the router holds them, including
+// across reconnection
+func TestSubscriptionModifyKeys(t *testing.T) {
+	producer := elvin.NewClient(testURL, nil, nil, nil)
+	consumer := elvin.NewClient(testURL, nil, nil, nil)
+	if err := producer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer producer.Disconnect()
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer consumer.Disconnect()
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "require(TestSubscriptionModifyKeys)"
+	sub.AcceptInsecure = false
+	sub.Notifications = make(chan map[string]interface{})
+	if err := consumer.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	producerKeys, consumerKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	_, otherKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k2)
+	notify := func(value string) {
+		if err := producer.Notify(map[string]interface{}{"TestSubscriptionModifyKeys": value}, false, producerKeys); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+	expect := func(value string) {
+		select {
+		case nfn := <-sub.Notifications:
+			if nfn["TestSubscriptionModifyKeys"] != value {
+				t.Errorf("Received %v, expected %s", nfn, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Nothing received, expected %s", value)
+		}
+	}
+	nothing := func() {
+		select {
+		case nfn := <-sub.Notifications:
+			t.Errorf("Received %v, expected nothing", nfn)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	held := func(expected int) {
+		if n := producerKeyCount(sub.Keys); n != expected {
+			t.Errorf("Subscription holds %d keys, expected %d: %v", n, expected, sub.Keys)
+		}
+	}
+
+	// Adding keys
+	if err := consumer.SubscriptionModify(sub, "", false, consumerKeys, nil); err != nil {
+		t.Fatalf("SubscriptionModify failed: %v", err)
+	}
+	if err := consumer.SubscriptionModify(sub, "", false, otherKeys, nil); err != nil {
+		t.Fatalf("SubscriptionModify failed: %v", err)
+	}
+	held(2)
+	notify("added")
+	expect("added")
+
+	// Deleting keys
+	if err := consumer.SubscriptionModify(sub, "", false, nil, consumerKeys); err != nil {
+		t.Fatalf("SubscriptionModify failed: %v", err)
+	}
+	held(1)
+	notify("deleted")
+	nothing()
+
+	// Reconnecting restores the same keys
+	_, consumerKeys = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := consumer.SubscriptionModify(sub, "", false, consumerKeys, nil); err != nil {
+		t.Fatalf("SubscriptionModify failed: %v", err)
+	}
+	if err := consumer.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if err := consumer.DefaultReconnect(1, 0, time.Second); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	held(2)
+	notify("reconnected")
+	expect("reconnected")
+}
+
+// A quench's keys are kept as the router holds them
+func TestQuenchModifyKeys(t *testing.T) {
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"TestQuenchModifyKeys": true}
+	quench.DeliverInsecure = false
+	quench.Notifications = make(chan elvin.QuenchNotification, 8)
+	if err := client.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+	defer client.QuenchDelete(quench)
+
+	producerKeys, consumerKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := client.QuenchModify(quench, nil, nil, false, producerKeys, nil); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	if producerKeyCount(quench.Keys) != 1 {
+		t.Errorf("Quench holds %v", quench.Keys)
+	}
+
+	// Only a subscription with matching keys is sent to the quench
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestQuenchModifyKeys == 1"
+	sub.AcceptInsecure = false
+	sub.Keys = consumerKeys
+	sub.Notifications = make(chan map[string]interface{})
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	quenchNotification(t, quench)
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Fatalf("Unsubscribe failed %v", err)
+	}
+	quenchNotification(t, quench)
+
+	producerKeys, _ = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := client.QuenchModify(quench, nil, nil, false, nil, producerKeys); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	if producerKeyCount(quench.Keys) != 0 {
+		t.Errorf("Quench holds %v", quench.Keys)
+	}
+	_, sub.Keys = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	noQuenchNotification(t, quench)
+	client.SubscriptionDelete(sub)
+}
+
+func TestQuenchSecurityChange(t *testing.T) {
+	producerKeys, consumerKeys := schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	quench := new(elvin.Quench)
+	quench.Names = map[string]bool{"TestQuenchSecurityChange": true}
+	quench.DeliverInsecure = true
+	quench.Keys = producerKeys
+	quench.Notifications = make(chan elvin.QuenchNotification, 8)
+	if err := client.Quench(quench); err != nil {
+		t.Fatalf("Quench failed %v", err)
+	}
+	defer client.QuenchDelete(quench)
+
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestQuenchSecurityChange == 1"
+	sub.AcceptInsecure = true
+	sub.Keys = consumerKeys
+	sub.Notifications = make(chan map[string]interface{})
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	defer client.SubscriptionDelete(sub)
+	added := quenchNotification(t, quench)
+
+	// The term is still sent once the keys go, but now insecurely
+	producerKeys, _ = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := client.QuenchModify(quench, nil, nil, true, nil, producerKeys); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	modified := quenchNotification(t, quench)
+	if modified.TermID != added.TermID || modified.SubExpr == nil {
+		t.Fatalf("Unexpected notification %+v", modified)
+	}
+
+	// And securely again once they're back
+	producerKeys, _ = schemeKeyBlocks(elvin.KeySchemeSha256Producer, k1)
+	if err := client.QuenchModify(quench, nil, nil, true, producerKeys, nil); err != nil {
+		t.Fatalf("QuenchModify failed %v", err)
+	}
+	modified = quenchNotification(t, quench)
+	if modified.TermID != added.TermID || modified.SubExpr == nil {
+		t.Fatalf("Unexpected notification %+v", modified)
+	}
+	noQuenchNotification(t, quench)
+}
+
+// The number of SHA-256 producer scheme keys in a KeyBlock
+func producerKeyCount(keys elvin.KeyBlock) int {
+	ksl := keys[elvin.KeySchemeSha256Producer]
+	if len(ksl) == 0 {
+		return 0
+	}
+	return len(ksl[elvin.KeySetProducer])
+}
@@ -30,19 +30,23 @@ type Subscription struct {
 	AcceptInsecure bool
 	Keys           elvin.KeyBlock
 	Ast            *elvin.AST
+	Predicate      elvin.Predicate // Ast compiled by the router's Predicates
 }
 
-// Parse a subscription expression into an AST
-func Parse(subexpr string) (ast *elvin.AST, n *elvin.Nack) {
-	// For now 'bogus' fails and everything else succeeds
-	if subexpr == "bogus" {
-		nack := new(elvin.Nack)
-		nack.ErrorCode = elvin.ErrorsParsing
-		nack.Message = elvin.ProtocolErrors[elvin.ErrorsParsing].Message
-		nack.Args = make([]interface{}, 2)
-		nack.Args[0] = "bogus"
-		nack.Args[1] = int32(0)
-		return nil, nack
+// The parser is stateless so one serves all clients
+var parser elvin.Parser
+
+// Parse a subscription expression into an AST, rejecting any that
+// are trivial or exceed the limits
+func Parse(subexpr string, limits elvin.ExpressionLimits) (ast *elvin.AST, n *elvin.Nack) {
+	ast, err := parser.Parse(subexpr)
+	if err == nil {
+		ast, err = elvin.Analyse(ast, limits)
+	}
+	if err != nil {
+		// Both only fail with a *ParseError which carries the
+		// error code, offending token and offset
+		return nil, err.(*elvin.ParseError).Nack()
 	}
-	return nil, nil
+	return ast, nil
 }
@@ -22,21 +22,28 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/cobaro/elvin/elvin"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 var client *elvin.Client
 
+// The router and its url for tests that need more than one client
+var testRouter *Router
+var testURL = "elvin://localhost:3917"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	// Create a router instance using standard test config
-	url := "elvin://localhost:3917"
+	url := testURL
 	protocol, _ := elvin.URLToProtocol(url)
 	var router Router
+	testRouter = &router
 	router.SetMaxConnections(10)
 	router.SetDoFailover(false)
 	router.SetTestConnInterval(10 * time.Second)
@@ -78,6 +85,56 @@ func TestSubscriptionFail(t *testing.T) {
 	}
 }
 
+func TestSubscriptionTrivial(t *testing.T) {
+	// A subscription that can never match is rejected
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestTrivial == 1 && 1 == 2"
+	sub.AcceptInsecure = true
+	sub.Keys = nil
+	sub.Notifications = make(chan map[string]interface{})
+
+	err := client.Subscribe(sub)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsExpIsTrivial)) {
+		t.Errorf("Subscribe returned %v", err)
+		return
+	}
+}
+
+func TestSubscriptionInvalid(t *testing.T) {
+	// Syntax errors are found without a round trip to the router
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestInvalid == 1 &&"
+	sub.AcceptInsecure = true
+	sub.Notifications = make(chan map[string]interface{})
+
+	err := client.Subscribe(sub)
+	if parseError, ok := err.(*elvin.ParseError); !ok || parseError.ErrorCode != elvin.ErrorsParsing || parseError.Offset() != 19 {
+		t.Errorf("Subscribe returned %v", err)
+	}
+
+	// Functions unknown locally are left for the router to judge
+	sub.Expression = "TestInvalid == 1 && no-such-function(TestInvalid)"
+	err = client.Subscribe(sub)
+	if _, ok := err.(*elvin.ParseError); ok || err == nil || !strings.Contains(err.Error(), fmt.Sprintf("[%d]", elvin.ErrorsUnknownFunction)) {
+		t.Errorf("Subscribe returned %v", err)
+	}
+
+	sub.Expression = "TestInvalid == 1"
+	if err := client.Subscribe(sub); err != nil {
+		t.Fatalf("Subscribe failed %v", err)
+	}
+	err = client.SubscriptionModify(sub, "TestInvalid ==", true, nil, nil)
+	if _, ok := err.(*elvin.ParseError); !ok {
+		t.Errorf("SubscriptionModify returned %v", err)
+	}
+	if sub.Expression != "TestInvalid == 1" {
+		t.Errorf("Invalid modification changed the expression to %s", sub.Expression)
+	}
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Errorf("Unsubscribe failed %v", err)
+	}
+}
+
 func TestSubscriptionPass(t *testing.T) {
 	// Create a client
 	// Add a subscription
@@ -116,3 +173,53 @@ func TestSubscriptionPass(t *testing.T) {
 	}
 
 }
+
+func TestSubscriptionNoMatch(t *testing.T) {
+	// Add a subscription that the first notification can't match
+	sub := new(elvin.Subscription)
+	sub.Expression = "TestNoMatch == 1"
+	sub.AcceptInsecure = true
+	sub.Keys = nil
+	sub.Notifications = make(chan map[string]interface{})
+
+	if err := client.Subscribe(sub); err != nil {
+		t.Errorf("Subscribe failed %v", err)
+		return
+	}
+
+	var nfn = map[string]interface{}{"TestNoMatch": int32(2)}
+	if err := client.Notify(nfn, true, nil); err != nil {
+		t.Errorf("Notify failed")
+		return
+	}
+
+	select {
+	case <-sub.Notifications:
+		t.Errorf("Received unmatched notification")
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// And now one that does
+	nfn = map[string]interface{}{"TestNoMatch": int32(1)}
+	if err := client.Notify(nfn, true, nil); err != nil {
+		t.Errorf("Notify failed")
+		return
+	}
+
+	select {
+	case nfn := <-sub.Notifications:
+		if nfn["TestNoMatch"] != int32(1) {
+			t.Errorf("Received unmatched notification")
+			return
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("Too slow!")
+		return
+	}
+
+	if err := client.SubscriptionDelete(sub); err != nil {
+		t.Errorf("Unsubscribe failed %v", err)
+		return
+	}
+}
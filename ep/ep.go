@@ -27,6 +27,7 @@ import (
 	"github.com/cobaro/elvin/elvin"
 	"os"
 	"os/signal"
+	"strings"
 )
 
 type arguments struct {
@@ -41,6 +42,7 @@ type arguments struct {
 	consumerKeyString string
 	consumerKeyHex    string
 	secureDelivery    bool
+	quench            string
 }
 
 func main() {
@@ -105,6 +107,24 @@ func main() {
 		ep.Logf(elog.LogLevelInfo1, "connected to %s", args.url)
 	}
 
+	// Optionally only send what someone could be interested in
+	var producer *elvin.Producer
+	if len(args.quench) > 0 {
+		if args.unotify {
+			ep.Logf(elog.LogLevelError, "Quenching requires a connection (not UNotify)")
+			os.Exit(1)
+		}
+		names := make(map[string]bool)
+		for _, name := range strings.Split(args.quench, ",") {
+			names[name] = true
+		}
+		var err error
+		if producer, err = elvin.NewProducer(ep, names, !args.secureDelivery, nil); err != nil {
+			ep.Logf(elog.LogLevelError, "Quench failed: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	// Grab a channel of notifications from our Parser
 	notifications := elvin.ParseNotifications(os.Stdin, os.Stderr, args.multiplier, ep.LogFunc())
 
@@ -120,6 +140,12 @@ Loop:
 						if err := ep.UNotify(notification, !args.secureDelivery, ep.KeysNfn); err != nil {
 							ep.Logf(elog.LogLevelInfo1, "UNotify failed: %v", err)
 						}
+					} else if producer != nil {
+						if sent, err := producer.Notify(notification, !args.secureDelivery, nil); err != nil {
+							ep.Logf(elog.LogLevelInfo1, "Notify failed: %v", err)
+						} else if !sent {
+							ep.Logf(elog.LogLevelDebug1, "Quenched %+v", notification)
+						}
 					} else {
 						if err := ep.Notify(notification, !args.secureDelivery, nil); err != nil {
 							ep.Logf(elog.LogLevelInfo1, "Notify failed: %v", err)
@@ -136,6 +162,12 @@ Loop:
 		}
 	}
 
+	if producer != nil {
+		if err := producer.Close(); err != nil {
+			ep.Logf(elog.LogLevelInfo1, "QuenchDel failed: %v", err)
+		}
+	}
+
 	if !args.unotify {
 		if err := ep.Disconnect(); err != nil {
 			ep.Logf(elog.LogLevelInfo1, "%v", err)
@@ -160,6 +192,7 @@ func flags() (args arguments) {
 	flag.StringVar(&args.consumerKeyString, "c", "", "SHA1 consumer public key (string) ")
 	flag.StringVar(&args.consumerKeyHex, "C", "", "SHA1 consumer public key (hex)")
 	flag.BoolVar(&args.secureDelivery, "x", false, "Don't allow insecure delivery (default is to allow)")
+	flag.StringVar(&args.quench, "q", "", "quench on these comma separated names, only sending notifications someone could match")
 	flag.Parse()
 
 	if args.help {
@@ -21,72 +21,239 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/cobaro/elvin/elvin"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"unicode/utf8"
 )
 
 // Read an Elvin subscription from the command-line, stdin, or a file.
-// Parse the subscription, and report any errors.  If no errors are
-// found, print the subscription as a parse tree.
+// Parse the subscription, and report any errors with their position
+// and Elvin error code.  If no errors are found, print the
+// subscription as a parse tree (or JSON) and optionally evaluate it
+// against a file of notifications.
 
-// Usage: esl [-f file-name | - | ...]
+// Usage: esl [-json] [-n notifications] [-f file-name | - | ...]
 // Read from file (-f), stdin (-) or command line arguments.
 
-func main() {
-
-	// Process arguments.
-	var fileName = flag.String("input", "", "Input file name")
-	var help = flag.Bool("help", false, "Request help with options")
-	var version = flag.Bool("version", false, "Print version info")
-
-	flag.Parse()
-
-	if *version {
-		fmt.Println("0.0.1")
-		os.Exit(0)
-	}
+type arguments struct {
+	fileName      string
+	notifications string
+	json          bool
+	help          bool
+	version       bool
+}
 
-	if *help {
-		fmt.Println("[-f filename | - | ... ]")
-		os.Exit(0)
-	}
+func main() {
+	args := flags()
 
 	var subExpr string
 
 	if flag.Arg(0) == "-" {
 		buffer, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			fmt.Println("Error reading from stdin")
+			fmt.Fprintln(os.Stderr, "Error reading from stdin")
 			os.Exit(1)
 		}
 
 		subExpr = string(buffer)
 
-	} else if *fileName != "" {
-		buffer, err := ioutil.ReadFile(*fileName)
+	} else if args.fileName != "" {
+		buffer, err := ioutil.ReadFile(args.fileName)
 		if err != nil {
-			fmt.Println("Error reading file")
+			fmt.Fprintln(os.Stderr, "Error reading file")
 			os.Exit(1)
 		}
 
 		subExpr = string(buffer)
 
 	} else {
-		for _, arg := range flag.Args() {
-			subExpr += " " + arg
-		}
+		subExpr = strings.Join(flag.Args(), " ")
 	}
-
-	// Create parser.
+	subExpr = strings.TrimRight(subExpr, "\n")
 
 	// Parse content, and run reductions.
+	var parser elvin.Parser
+	ast, err := parser.Parse(subExpr)
+	if err != nil {
+		if parseError, ok := err.(*elvin.ParseError); ok {
+			reportError(subExpr, parseError)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
 
-	fmt.Println(subExpr)
+	if args.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(jsonTree(ast))
+	} else {
+		fmt.Println(ast)
+		printTree(os.Stdout, ast, "")
+	}
 
-	elvin.Lexer(subExpr)
+	if args.notifications != "" {
+		file, err := os.Open(args.notifications)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading notifications: %v\n", err)
+			os.Exit(1)
+		}
+		evaluate(os.Stdout, ast, file)
+		file.Close()
+	}
 
 	os.Exit(0)
 }
+
+// Show where in the expression an error was found, by line and column
+func reportError(subExpr string, parseError *elvin.ParseError) {
+	offset := parseError.Offset()
+	if offset > len(subExpr) {
+		offset = len(subExpr)
+	}
+
+	start := strings.LastIndex(subExpr[:offset], "\n") + 1
+	end := strings.Index(subExpr[offset:], "\n")
+	if end < 0 {
+		end = len(subExpr)
+	} else {
+		end += offset
+	}
+	line := strings.Count(subExpr[:offset], "\n") + 1
+	column := utf8.RuneCountInString(subExpr[start:offset]) + 1
+
+	fmt.Fprintln(os.Stderr, subExpr[start:end])
+	fmt.Fprintf(os.Stderr, "%s^\n", strings.Repeat(" ", column-1))
+	fmt.Fprintf(os.Stderr, "line %d column %d: error %d: %s\n", line, column,
+		parseError.ErrorCode,
+		fmt.Sprintf(elvin.ElvinStringToFormatString(elvin.ProtocolErrors[parseError.ErrorCode].Message), parseError.Args...))
+}
+
+// Labels for operator nodes in the tree
+var labels = map[int]string{
+	elvin.LogicalOrTypeCode:           "||",
+	elvin.LogicalExclusiveOrTypeCode:  "^^",
+	elvin.LogicalAndTypeCode:          "&&",
+	elvin.LogicalNotTypeCode:          "!",
+	elvin.EqualsTypeCode:              "==",
+	elvin.NotEqualsTypeCode:           "!=",
+	elvin.LessThanTypeCode:            "<",
+	elvin.LessThanOrEqualsTypeCode:    "<=",
+	elvin.GreaterThanTypeCode:         ">",
+	elvin.GreaterThanOrEqualsTypeCode: ">=",
+	elvin.BinaryOrTypeCode:            "|",
+	elvin.BinaryExclusiveOrTypeCode:   "^",
+	elvin.BinaryAndTypeCode:           "&",
+	elvin.ShiftLeftTypeCode:           "<<",
+	elvin.ShiftRightTypeCode:          ">>",
+	elvin.LogicalShiftRightTypeCode:   ">>>",
+	elvin.AddTypeCode:                 "+",
+	elvin.SubtractTypeCode:            "-",
+	elvin.MultiplyTypeCode:            "*",
+	elvin.DivideTypeCode:              "/",
+	elvin.ModuloTypeCode:              "%",
+	elvin.UnaryPlusTypeCode:           "unary +",
+	elvin.UnaryMinusTypeCode:          "unary -",
+	elvin.BinaryNotTypeCode:           "~",
+}
+
+// The type and (where there is one) value of a node
+func label(node *elvin.AST) (string, interface{}) {
+	switch node.TypeCode {
+	case elvin.NameTypeCode:
+		return "name", node.Value
+	case elvin.Int32TypeCode:
+		return "int32", node.Value
+	case elvin.Int64TypeCode:
+		return "int64", node.Value
+	case elvin.Real64TypeCode:
+		return "real64", node.Value
+	case elvin.StringTypeCode:
+		return "string", node.Value
+	}
+	if op, ok := labels[node.TypeCode]; ok {
+		return op, nil
+	}
+	// Functions carry their name
+	return fmt.Sprintf("%v()", node.Value), nil
+}
+
+// Print an indented parse tree
+func printTree(out io.Writer, node *elvin.AST, indent string) {
+	kind, value := label(node)
+	switch value.(type) {
+	case nil:
+		fmt.Fprintf(out, "%s%s\n", indent, kind)
+	case string:
+		fmt.Fprintf(out, "%s%s %q\n", indent, kind, value)
+	default:
+		fmt.Fprintf(out, "%s%s %v\n", indent, kind, value)
+	}
+	for _, child := range node.Children {
+		printTree(out, child, indent+"  ")
+	}
+}
+
+// A node as JSON
+type jsonNode struct {
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value,omitempty"`
+	Children []*jsonNode `json:"children,omitempty"`
+}
+
+func jsonTree(node *elvin.AST) *jsonNode {
+	kind, value := label(node)
+	j := &jsonNode{Type: kind, Value: value}
+	for _, child := range node.Children {
+		j.Children = append(j.Children, jsonTree(child))
+	}
+	return j
+}
+
+// Evaluate the subscription against each notification
+func evaluate(out io.Writer, ast *elvin.AST, in io.Reader) {
+	results := map[int]string{
+		elvin.LukTrue:   "true",
+		elvin.LukFalse:  "false",
+		elvin.LukBottom: "bottom",
+	}
+
+	i := 0
+	for nfn := range elvin.ParseNotifications(in, os.Stderr, 0, fmt.Fprintf) {
+		i++
+		fmt.Fprintf(out, "notification %d: %s\n", i, results[ast.Eval(nfn)])
+	}
+}
+
+// Argument parsing
+func flags() (args arguments) {
+	flag.StringVar(&args.fileName, "f", "", "read the subscription from this file")
+	flag.StringVar(&args.fileName, "input", "", "same as -f")
+	flag.StringVar(&args.notifications, "n", "", "evaluate against the notifications in this file")
+	flag.BoolVar(&args.json, "json", false, "print the parse tree as JSON")
+	flag.BoolVar(&args.help, "help", false, "Request help with options")
+	flag.BoolVar(&args.version, "version", false, "Print version info")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [-f filename | - | expression ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if args.version {
+		fmt.Println("0.0.1")
+		os.Exit(0)
+	}
+
+	if args.help {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	return args
+}